@@ -0,0 +1,312 @@
+// Package aferofs adapts an *sftp.Client to the afero.Fs interface from
+// github.com/spf13/afero, so that code written against afero can use a
+// remote SFTP server as its storage.
+//
+// It is a module of its own so that github.com/pkg/sftp itself does not
+// depend on afero.
+package aferofs
+
+import (
+	"io"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+)
+
+// Fs is an afero.Fs backed by an SFTP client.
+type Fs struct {
+	client *sftp.Client
+}
+
+// assert that *Fs implements afero.Fs
+var _ afero.Fs = new(Fs)
+
+// New returns an afero.Fs on top of client. Closing client is left to the
+// caller.
+func New(client *sftp.Client) *Fs {
+	return &Fs{client: client}
+}
+
+// Name returns the name of this filesystem.
+func (fs *Fs) Name() string { return "sftp" }
+
+// Create creates or truncates the named file.
+func (fs *Fs) Create(name string) (afero.File, error) {
+	fd, err := fs.client.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &File{client: fs.client, name: name, fd: fd}, nil
+}
+
+// Mkdir creates the named directory with permissions perm.
+func (fs *Fs) Mkdir(name string, perm os.FileMode) error {
+	if err := fs.client.Mkdir(name); err != nil {
+		return err
+	}
+	return fs.client.Chmod(name, perm)
+}
+
+// MkdirAll creates the directory name and any missing parents, like
+// os.MkdirAll. The permissions perm are applied to the directories it
+// creates, and not to those which already exist.
+func (fs *Fs) MkdirAll(name string, perm os.FileMode) error {
+	fi, err := fs.client.Stat(name)
+	if err == nil {
+		if fi.IsDir() {
+			return nil
+		}
+		return &os.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	if parent := path.Dir(name); parent != name && parent != "." {
+		if err := fs.MkdirAll(parent, perm); err != nil {
+			return err
+		}
+	}
+	if err := fs.client.Mkdir(name); err != nil {
+		// name may be something like "foo/.", or have been created since
+		if fi, err1 := fs.client.Lstat(name); err1 == nil && fi.IsDir() {
+			return nil
+		}
+		return err
+	}
+	return fs.client.Chmod(name, perm)
+}
+
+// Open opens the named file or directory for reading.
+func (fs *Fs) Open(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens the named file with the given flags. If the file is
+// created its permissions are set to perm.
+//
+// Directories can only be opened read-only, and only for Readdir and Stat.
+func (fs *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	fi, err := fs.client.Stat(name)
+	switch {
+	case err == nil && fi.IsDir():
+		if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EEXIST}
+		}
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		return &File{client: fs.client, name: name}, nil
+	case err != nil && !os.IsNotExist(err):
+		return nil, err
+	}
+	created := err != nil && flag&os.O_CREATE != 0
+	fd, err := fs.client.OpenFile(name, flag)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		if err := fd.Chmod(perm); err != nil {
+			fd.Close()
+			return nil, err
+		}
+	}
+	return &File{client: fs.client, name: name, fd: fd}, nil
+}
+
+// Remove removes the named file or empty directory.
+func (fs *Fs) Remove(name string) error {
+	return fs.client.Remove(name)
+}
+
+// RemoveAll removes path and everything below it. It returns nil if path
+// does not exist.
+func (fs *Fs) RemoveAll(path string) error {
+	fi, err := fs.client.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fs.client.Remove(path)
+	}
+	entries, err := fs.client.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		if err := fs.RemoveAll(fs.client.Join(path, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return fs.client.RemoveDirectory(path)
+}
+
+// Rename renames oldname to newname.
+func (fs *Fs) Rename(oldname, newname string) error {
+	return fs.client.Rename(oldname, newname)
+}
+
+// Stat returns a FileInfo describing the named file.
+func (fs *Fs) Stat(name string) (os.FileInfo, error) {
+	return fs.client.Stat(name)
+}
+
+// Chmod changes the permissions of the named file.
+func (fs *Fs) Chmod(name string, mode os.FileMode) error {
+	return fs.client.Chmod(name, mode)
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (fs *Fs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return fs.client.Chtimes(name, atime, mtime)
+}
+
+// File is an afero.File on an SFTP server. It is either a regular file
+// opened on the server, or a directory that can be listed with Readdir.
+type File struct {
+	client *sftp.Client
+	name   string
+	fd     *sftp.File // nil for a directory
+
+	entries []os.FileInfo // remaining directory entries, once read
+	listed  bool
+}
+
+// Name returns the name of the file as presented to Open.
+func (f *File) Name() string { return f.name }
+
+// Close closes the file.
+func (f *File) Close() error {
+	if f.fd == nil {
+		return nil
+	}
+	return f.fd.Close()
+}
+
+// Stat returns a FileInfo describing the file.
+func (f *File) Stat() (os.FileInfo, error) {
+	if f.fd == nil {
+		return f.client.Stat(f.name)
+	}
+	return f.fd.Stat()
+}
+
+// Readdir reads the directory and returns up to count of its entries, or
+// all remaining entries if count <= 0, following os.File.Readdir.
+func (f *File) Readdir(count int) ([]os.FileInfo, error) {
+	if f.fd != nil {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+	if !f.listed {
+		entries, err := f.client.ReadDir(f.name)
+		if err != nil {
+			return nil, err
+		}
+		f.entries, f.listed = entries, true
+	}
+	if count <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(f.entries) {
+		count = len(f.entries)
+	}
+	entries := f.entries[:count]
+	f.entries = f.entries[count:]
+	return entries, nil
+}
+
+// Readdirnames is like Readdir, returning only the names of the entries.
+func (f *File) Readdirnames(n int) ([]string, error) {
+	entries, err := f.Readdir(n)
+	names := make([]string, len(entries))
+	for i, fi := range entries {
+		names[i] = path.Base(fi.Name())
+	}
+	return names, err
+}
+
+func (f *File) isDirErr(op string) error {
+	return &os.PathError{Op: op, Path: f.name, Err: syscall.EISDIR}
+}
+
+// Read reads from the file at the current offset. As with os.File, io.EOF
+// is only returned once no more bytes could be read.
+func (f *File) Read(b []byte) (int, error) {
+	if f.fd == nil {
+		return 0, f.isDirErr("read")
+	}
+	n, err := f.fd.Read(b)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt reads from the file at offset off.
+func (f *File) ReadAt(b []byte, off int64) (int, error) {
+	if f.fd == nil {
+		return 0, f.isDirErr("read")
+	}
+	return f.fd.ReadAt(b, off)
+}
+
+// Seek sets the offset for the next Read or Write.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	if f.fd == nil {
+		return 0, f.isDirErr("seek")
+	}
+	return f.fd.Seek(offset, whence)
+}
+
+// Write writes to the file at the current offset.
+func (f *File) Write(b []byte) (int, error) {
+	if f.fd == nil {
+		return 0, f.isDirErr("write")
+	}
+	return f.fd.Write(b)
+}
+
+// WriteAt writes to the file at offset off, leaving the offset used by Read
+// and Write alone.
+func (f *File) WriteAt(b []byte, off int64) (int, error) {
+	if f.fd == nil {
+		return 0, f.isDirErr("write")
+	}
+	return f.fd.WriteAt(b, off)
+}
+
+// WriteString writes s to the file at the current offset.
+func (f *File) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+// Truncate changes the size of the file.
+func (f *File) Truncate(size int64) error {
+	if f.fd == nil {
+		return f.isDirErr("truncate")
+	}
+	return f.fd.Truncate(size)
+}
+
+// Sync asks the server to flush the file to stable storage, with the
+// fsync@openssh.com extension. Writes are acknowledged by the server before
+// Write returns, so on a server without the extension Sync does nothing.
+// Sync on a directory does nothing.
+func (f *File) Sync() error {
+	if f.fd == nil {
+		return nil
+	}
+	err := f.fd.Sync()
+	if serr, ok := err.(*sftp.StatusError); ok && serr.FxCode() == sftp.ErrSSHFxOpUnsupported {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,488 @@
+package aferofs
+
+// These tests are a subset of afero's own Fs test suite, run against an
+// in-process sftp.Server serving the local filesystem.
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+)
+
+func testFs(t *testing.T) (*Fs, func()) {
+	c1, c2 := net.Pipe()
+	server, err := sftp.NewServer(c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	client, err := sftp.NewClientPipe(c2, c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(client), func() {
+		client.Close()
+		server.Close()
+	}
+}
+
+func testDir(t *testing.T, fs *Fs) string {
+	name, err := afero.TempDir(fs, "", "aferofs")
+	if err != nil {
+		t.Fatal("unable to work with test dir:", err)
+	}
+	return name
+}
+
+func tmpFile(t *testing.T, fs *Fs) afero.File {
+	f, err := afero.TempFile(fs, "", "aferofs")
+	if err != nil {
+		t.Fatal("unable to work with temp file:", err)
+	}
+	return f
+}
+
+func checkSize(t *testing.T, f afero.File, size int64) {
+	t.Helper()
+	dir, err := f.Stat()
+	if err != nil {
+		t.Fatalf("Stat %q (looking for size %d): %s", f.Name(), size, err)
+	}
+	if dir.Size() != size {
+		t.Errorf("Stat %q: size %d want %d", f.Name(), dir.Size(), size)
+	}
+}
+
+// Read with length 0 should not return EOF.
+func TestRead0(t *testing.T) {
+	fs, done := testFs(t)
+	defer done()
+	f := tmpFile(t, fs)
+	defer fs.Remove(f.Name())
+	defer f.Close()
+	f.WriteString("Lorem ipsum dolor sit amet, consectetur adipisicing elit")
+
+	var b []byte
+	n, err := f.Read(b)
+	if n != 0 || err != nil {
+		t.Errorf("Read(0) = %d, %v, want 0, nil", n, err)
+	}
+	f.Seek(0, 0)
+	b = make([]byte, 100)
+	n, err = f.Read(b)
+	if n <= 0 || err != nil {
+		t.Errorf("Read(100) = %d, %v, want >0, nil", n, err)
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	fs, done := testFs(t)
+	defer done()
+	tmp := testDir(t, fs)
+	defer fs.RemoveAll(tmp)
+	name := path.Join(tmp, "test.txt")
+
+	f, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal("OpenFile (O_CREATE) failed:", err)
+	}
+	io.WriteString(f, "initial")
+	f.Close()
+	if fi, err := os.Stat(name); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("created with mode %v, want 0600", fi.Mode().Perm())
+	}
+
+	f, err = fs.OpenFile(name, os.O_RDWR|os.O_TRUNC, 0600)
+	if err != nil {
+		t.Fatal("OpenFile (O_TRUNC) failed:", err)
+	}
+	contents, _ := ioutil.ReadAll(f)
+	if string(contents) != "" {
+		t.Errorf("expected truncated file, got: '%v'", string(contents))
+	}
+	f.Close()
+
+	if _, err := fs.OpenFile(tmp, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0700); !os.IsExist(err) {
+		t.Errorf("OpenFile (O_CREATE|O_EXCL) of a directory: want an exist error, got %v", err)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	fs, done := testFs(t)
+	defer done()
+	tmp := testDir(t, fs)
+	defer fs.RemoveAll(tmp)
+	name := path.Join(tmp, "test.txt")
+
+	f, err := fs.Create(name)
+	if err != nil {
+		t.Fatal("Create failed:", err)
+	}
+	io.WriteString(f, "initial")
+	f.Close()
+
+	f, err = fs.Create(name)
+	if err != nil {
+		t.Fatal("Create failed:", err)
+	}
+	secondContent := "second create"
+	io.WriteString(f, secondContent)
+	f.Close()
+
+	f, err = fs.Open(name)
+	if err != nil {
+		t.Fatal("Open failed:", err)
+	}
+	buf, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Error("ReadAll failed:", err)
+	}
+	if string(buf) != secondContent {
+		t.Errorf("Create did not truncate, got %q", string(buf))
+	}
+	f.Close()
+}
+
+func TestRename(t *testing.T) {
+	fs, done := testFs(t)
+	defer done()
+	tDir := testDir(t, fs)
+	defer fs.RemoveAll(tDir)
+	from := path.Join(tDir, "renamefrom")
+	to := path.Join(tDir, "renameto")
+
+	file, err := fs.Create(from)
+	if err != nil {
+		t.Fatalf("open %q failed: %v", from, err)
+	}
+	if err = file.Close(); err != nil {
+		t.Errorf("close %q failed: %v", from, err)
+	}
+	if err = fs.Rename(from, to); err != nil {
+		t.Fatalf("rename %q, %q failed: %v", from, to, err)
+	}
+	names, err := afero.ReadDir(fs, tDir)
+	if err != nil {
+		t.Fatalf("ReadDir error: %v", err)
+	}
+	if len(names) != 1 || names[0].Name() != "renameto" {
+		t.Errorf("unexpected directory contents after rename: %v", names)
+	}
+	if _, err = fs.Stat(to); err != nil {
+		t.Errorf("stat %q failed: %v", to, err)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	fs, done := testFs(t)
+	defer done()
+	x := tmpFile(t, fs)
+	name := x.Name()
+	x.Close()
+
+	if err := fs.Remove(name); err != nil {
+		t.Fatalf("Remove() failed: %v", err)
+	}
+	if _, err := fs.Stat(name); !os.IsNotExist(err) {
+		t.Fatalf("Remove() didn't remove file")
+	}
+	// Deleting non-existent file should raise error
+	if err := fs.Remove(name); !os.IsNotExist(err) {
+		t.Errorf("Remove() didn't raise error for non-existent file")
+	}
+
+	f, err := fs.Open(path.Dir(name))
+	if err != nil {
+		t.Fatal("TestDir should still exist:", err)
+	}
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		t.Error("Readdirnames failed:", err)
+	}
+	for _, e := range names {
+		if e == path.Base(name) {
+			t.Error("File was not removed from parent directory")
+		}
+	}
+}
+
+func TestRemoveAll(t *testing.T) {
+	fs, done := testFs(t)
+	defer done()
+	tDir := testDir(t, fs)
+	if err := fs.MkdirAll(path.Join(tDir, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(fs, path.Join(tDir, "a", "b", "c"), []byte("c"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.RemoveAll(tDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tDir); !os.IsNotExist(err) {
+		t.Fatalf("RemoveAll left %s behind: %v", tDir, err)
+	}
+	if err := fs.RemoveAll(tDir); err != nil {
+		t.Fatalf("RemoveAll of a missing path: %v", err)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	fs, done := testFs(t)
+	defer done()
+	f := tmpFile(t, fs)
+	defer fs.Remove(f.Name())
+	defer f.Close()
+
+	checkSize(t, f, 0)
+	f.Write([]byte("hello, world\n"))
+	checkSize(t, f, 13)
+	f.Truncate(10)
+	checkSize(t, f, 10)
+	f.Truncate(1024)
+	checkSize(t, f, 1024)
+	f.Truncate(0)
+	checkSize(t, f, 0)
+	_, err := f.Write([]byte("surprise!"))
+	if err == nil {
+		checkSize(t, f, 13+9) // wrote at offset past where hello, world was.
+	}
+}
+
+func TestSeek(t *testing.T) {
+	fs, done := testFs(t)
+	defer done()
+	f := tmpFile(t, fs)
+	defer fs.Remove(f.Name())
+	defer f.Close()
+
+	const data = "hello, world\n"
+	io.WriteString(f, data)
+
+	type test struct {
+		in     int64
+		whence int
+		out    int64
+	}
+	var tests = []test{
+		{0, 1, int64(len(data))},
+		{0, 0, 0},
+		{5, 0, 5},
+		{0, 2, int64(len(data))},
+		{0, 0, 0},
+		{-1, 2, int64(len(data)) - 1},
+		{1 << 33, 0, 1 << 33},
+		{1 << 33, 2, 1<<33 + int64(len(data))},
+	}
+	for i, tt := range tests {
+		off, err := f.Seek(tt.in, tt.whence)
+		if off != tt.out || err != nil {
+			t.Errorf("#%d: Seek(%v, %v) = %v, %v want %v, nil", i, tt.in, tt.whence, off, err, tt.out)
+		}
+	}
+}
+
+func TestReadAt(t *testing.T) {
+	fs, done := testFs(t)
+	defer done()
+	f := tmpFile(t, fs)
+	defer fs.Remove(f.Name())
+	defer f.Close()
+
+	const data = "hello, world\n"
+	io.WriteString(f, data)
+
+	b := make([]byte, 5)
+	n, err := f.ReadAt(b, 7)
+	if err != nil || n != len(b) {
+		t.Fatalf("ReadAt 7: %d, %v", n, err)
+	}
+	if string(b) != "world" {
+		t.Fatalf("ReadAt 7: have %q want %q", string(b), "world")
+	}
+}
+
+func TestWriteAt(t *testing.T) {
+	fs, done := testFs(t)
+	defer done()
+	f := tmpFile(t, fs)
+	defer fs.Remove(f.Name())
+	defer f.Close()
+
+	const data = "hello, world\n"
+	io.WriteString(f, data)
+
+	n, err := f.WriteAt([]byte("WORLD"), 7)
+	if err != nil || n != 5 {
+		t.Fatalf("WriteAt 7: %d, %v", n, err)
+	}
+
+	f2, err := fs.Open(f.Name())
+	if err != nil {
+		t.Fatalf("ReadFile %s: %v", f.Name(), err)
+	}
+	defer f2.Close()
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(f2)
+	if b := buf.Bytes(); string(b) != "hello, WORLD\n" {
+		t.Fatalf("after write: have %q want %q", string(b), "hello, WORLD\n")
+	}
+}
+
+func TestReaddir(t *testing.T) {
+	fs, done := testFs(t)
+	defer done()
+	tDir := testDir(t, fs)
+	defer fs.RemoveAll(tDir)
+	want := []string{"testfile1", "testfile2", "testfile3", "testsubdir"}
+	for _, name := range want[:3] {
+		if err := afero.WriteFile(fs, path.Join(tDir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.Mkdir(path.Join(tDir, want[3]), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := fs.Open(tDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	var names []string
+	for {
+		infos, err := root.Readdir(1)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != 1 {
+			t.Fatalf("Readdir(1) returned %d entries", len(infos))
+		}
+		names = append(names, infos[0].Name())
+	}
+	sort.Strings(names)
+	if !equalNames(names, want) {
+		t.Errorf("Readdir = %v, want %v", names, want)
+	}
+
+	root2, err := fs.Open(tDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root2.Close()
+	names, err = root2.Readdirnames(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if !equalNames(names, want) {
+		t.Errorf("Readdirnames = %v, want %v", names, want)
+	}
+}
+
+func TestChmodChtimes(t *testing.T) {
+	fs, done := testFs(t)
+	defer done()
+	f := tmpFile(t, fs)
+	defer fs.Remove(f.Name())
+	f.Close()
+
+	if err := fs.Chmod(f.Name(), 0640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(1985, 6, 12, 6, 6, 6, 0, time.UTC)
+	if err := fs.Chtimes(f.Name(), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := fs.Stat(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("mode %v, want 0640", fi.Mode().Perm())
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("mtime %v, want %v", fi.ModTime(), mtime)
+	}
+}
+
+func TestMkdirAll(t *testing.T) {
+	fs, done := testFs(t)
+	defer done()
+	dir := testDir(t, fs)
+	defer fs.RemoveAll(dir)
+	if err := fs.Chmod(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.MkdirAll(path.Join(dir, "a", "b"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.MkdirAll(dir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	for p, want := range map[string]os.FileMode{
+		dir:                      0700,
+		path.Join(dir, "a"):      0750,
+		path.Join(dir, "a", "b"): 0750,
+	} {
+		fi, err := fs.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.IsDir() || fi.Mode().Perm() != want {
+			t.Errorf("%s: mode %v, want a directory with %v", p, fi.Mode(), want)
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	fs, done := testFs(t)
+	defer done()
+	f := tmpFile(t, fs)
+	defer fs.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.WriteString("synced"); err != nil {
+		t.Fatal(err)
+	}
+	// the test server has no fsync@openssh.com, which is not an error
+	if err := f.Sync(); err != nil {
+		t.Errorf("Sync: %v", err)
+	}
+
+	d, err := fs.Open(path.Dir(f.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		t.Errorf("Sync of a directory: %v", err)
+	}
+}
+
+func equalNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
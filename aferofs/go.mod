@@ -0,0 +1,10 @@
+module github.com/pkg/sftp/aferofs
+
+go 1.13
+
+require (
+	github.com/pkg/sftp v1.12.0
+	github.com/spf13/afero v1.2.2
+)
+
+replace github.com/pkg/sftp => ../
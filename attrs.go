@@ -102,38 +102,73 @@ func unmarshalAttrs(b []byte) (*FileStat, []byte) {
 	return getFileStat(flags, b)
 }
 
+// getFileStat decodes the attributes flags says are in b, stopping at the
+// first one which is cut short.
 func getFileStat(flags uint32, b []byte) (*FileStat, []byte) {
+	fs, b, _ := getFileStatSafe(flags, b)
+	return fs, b
+}
+
+// minExtendedPairSize is the wire size of an extended attribute pair with an
+// empty type and data: two string lengths.
+const minExtendedPairSize = 8
+
+// getFileStatSafe is like getFileStat, but fails with errShortPacket if b is
+// too short for the fields flags says are there, or for the number of
+// extended pairs the extended-count claims, rather than misreading whatever
+// follows the attributes. The attributes decoded so far are still returned.
+func getFileStatSafe(flags uint32, b []byte) (*FileStat, []byte, error) {
 	var fs FileStat
+	var err error
 	if flags&sshFileXferAttrSize == sshFileXferAttrSize {
-		fs.Size, b, _ = unmarshalUint64Safe(b)
-	}
-	if flags&sshFileXferAttrUIDGID == sshFileXferAttrUIDGID {
-		fs.UID, b, _ = unmarshalUint32Safe(b)
+		if fs.Size, b, err = unmarshalUint64Safe(b); err != nil {
+			return &fs, b, err
+		}
 	}
 	if flags&sshFileXferAttrUIDGID == sshFileXferAttrUIDGID {
-		fs.GID, b, _ = unmarshalUint32Safe(b)
+		if fs.UID, b, err = unmarshalUint32Safe(b); err != nil {
+			return &fs, b, err
+		}
+		if fs.GID, b, err = unmarshalUint32Safe(b); err != nil {
+			return &fs, b, err
+		}
 	}
 	if flags&sshFileXferAttrPermissions == sshFileXferAttrPermissions {
-		fs.Mode, b, _ = unmarshalUint32Safe(b)
+		if fs.Mode, b, err = unmarshalUint32Safe(b); err != nil {
+			return &fs, b, err
+		}
 	}
 	if flags&sshFileXferAttrACmodTime == sshFileXferAttrACmodTime {
-		fs.Atime, b, _ = unmarshalUint32Safe(b)
-		fs.Mtime, b, _ = unmarshalUint32Safe(b)
+		if fs.Atime, b, err = unmarshalUint32Safe(b); err != nil {
+			return &fs, b, err
+		}
+		if fs.Mtime, b, err = unmarshalUint32Safe(b); err != nil {
+			return &fs, b, err
+		}
 	}
 	if flags&sshFileXferAttrExtented == sshFileXferAttrExtented {
 		var count uint32
-		count, b, _ = unmarshalUint32Safe(b)
-		ext := make([]StatExtended, count)
+		if count, b, err = unmarshalUint32Safe(b); err != nil {
+			return &fs, b, err
+		}
+		// check the count against what is left before allocating for it
+		if uint64(count)*minExtendedPairSize > uint64(len(b)) {
+			return &fs, b, errShortPacket
+		}
+		ext := make([]StatExtended, 0, count)
 		for i := uint32(0); i < count; i++ {
-			var typ string
-			var data string
-			typ, b, _ = unmarshalStringSafe(b)
-			data, b, _ = unmarshalStringSafe(b)
-			ext[i] = StatExtended{typ, data}
+			var typ, data string
+			if typ, b, err = unmarshalStringSafe(b); err != nil {
+				return &fs, b, err
+			}
+			if data, b, err = unmarshalStringSafe(b); err != nil {
+				return &fs, b, err
+			}
+			ext = append(ext, StatExtended{typ, data})
 		}
 		fs.Extended = ext
 	}
-	return &fs, b
+	return &fs, b, nil
 }
 
 func marshalFileInfo(b []byte, fi os.FileInfo) []byte {
@@ -173,10 +208,17 @@ func marshalFileInfo(b []byte, fi os.FileInfo) []byte {
 	return b
 }
 
-// toFileMode converts sftp filemode bits to the os.FileMode specification
+// toFileMode converts sftp filemode bits to the os.FileMode specification.
+// A mode without file type bits, as sent by servers which only report
+// permissions, is taken to be a regular file. Type bits which match none of
+// the POSIX file types are mapped to os.ModeIrregular, rather than passed
+// off as a regular file; the raw mode remains available from the FileStat
+// returned by Sys.
 func toFileMode(mode uint32) os.FileMode {
 	var fm = os.FileMode(mode & 0777)
 	switch mode & S_IFMT {
+	case 0:
+		// no type given
 	case syscall.S_IFBLK:
 		fm |= os.ModeDevice
 	case syscall.S_IFCHR:
@@ -191,6 +233,8 @@ func toFileMode(mode uint32) os.FileMode {
 		// nothing to do
 	case syscall.S_IFSOCK:
 		fm |= os.ModeSocket
+	default:
+		fm |= os.ModeIrregular
 	}
 	if mode&syscall.S_ISGID != 0 {
 		fm |= os.ModeSetgid
@@ -43,3 +43,111 @@ func TestUnmarshalAttrs(t *testing.T) {
 		}
 	}
 }
+
+func TestUnmarshalAttrsSkippedFields(t *testing.T) {
+	// only perms and acmodtime are present, so the first field on the wire
+	// is the permissions and nothing may be read as a size or uid/gid
+	b := marshal(nil, struct {
+		Flags        uint32
+		Permissions  uint32
+		Atime, Mtime uint32
+		Trailing     uint32
+	}{sshFileXferAttrPermissions | sshFileXferAttrACmodTime, 0100755, 1000000000, 1234567890, 0xdeadbeef})
+	stat, rest := unmarshalAttrs(b)
+	want := &FileStat{Mode: 0100755, Atime: 1000000000, Mtime: 1234567890}
+	if !reflect.DeepEqual(stat, want) {
+		t.Errorf("unmarshalAttrs: want %#v, got %#v", want, stat)
+	}
+	if wantRest := marshalUint32(nil, 0xdeadbeef); !bytes.Equal(rest, wantRest) {
+		t.Errorf("unmarshalAttrs: want rest %x, got %x", wantRest, rest)
+	}
+}
+
+func TestUnmarshalAttrsFileTypes(t *testing.T) {
+	for _, tt := range []struct {
+		mode uint32
+		want os.FileMode
+	}{
+		{0644, 0644}, // no type bits: a regular file
+		{0100644, 0644},
+		{0040755, os.ModeDir | 0755},
+		{0120777, os.ModeSymlink | 0777},
+		{0010600, os.ModeNamedPipe | 0600},
+		{0140755, os.ModeSocket | 0755},
+		{0020600, os.ModeDevice | os.ModeCharDevice | 0600},
+		{0060600, os.ModeDevice | 0600},
+		{0160644, os.ModeIrregular | 0644}, // BSD whiteout, unknown here
+		{0170644 | 04000, os.ModeIrregular | os.ModeSetuid | 0644},
+	} {
+		b := marshal(nil, struct {
+			Flags        uint32
+			Size         uint64
+			Permissions  uint32
+			Atime, Mtime uint32
+		}{sshFileXferAttrSize | sshFileXferAttrPermissions | sshFileXferAttrACmodTime, 20, tt.mode, 1, 1234567890})
+		stat, _ := unmarshalAttrs(b)
+		fi := fileInfoFromStat(stat, "f")
+		if fi.Mode() != tt.want {
+			t.Errorf("mode %#o: got %v, want %v", tt.mode, fi.Mode(), tt.want)
+		}
+		if fi.Size() != 20 || fi.ModTime().Unix() != 1234567890 {
+			t.Errorf("mode %#o: got size %d and mtime %d, want 20 and 1234567890", tt.mode, fi.Size(), fi.ModTime().Unix())
+		}
+		if got := fi.Sys().(*FileStat).Mode; got != tt.mode {
+			t.Errorf("mode %#o: Sys has mode %#o", tt.mode, got)
+		}
+	}
+}
+
+func TestUnmarshalAttrsExtended(t *testing.T) {
+	b := marshal(nil, struct {
+		Flags       uint32
+		Size        uint64
+		Count       uint32
+		Type1       string
+		Data1       string
+		Type2       string
+		Data2       string
+		Trailing    string
+		TrailingInt uint32
+	}{sshFileXferAttrSize | sshFileXferAttrExtented, 20, 2, "one@example.com", "1", "two@example.com", "", "next", 42})
+	stat, rest := unmarshalAttrs(b)
+	want := &FileStat{Size: 20, Extended: []StatExtended{
+		{ExtType: "one@example.com", ExtData: "1"},
+		{ExtType: "two@example.com", ExtData: ""},
+	}}
+	if !reflect.DeepEqual(stat, want) {
+		t.Errorf("unmarshalAttrs: want %#v, got %#v", want, stat)
+	}
+	// what follows the attributes must be where the caller expects it
+	s, rest, err := unmarshalStringSafe(rest)
+	if err != nil || s != "next" {
+		t.Fatalf("trailing string: got %q, %v; want %q", s, err, "next")
+	}
+	if n, rest := unmarshalUint32(rest); n != 42 || len(rest) != 0 {
+		t.Errorf("trailing uint32: got %d with %d bytes left, want 42 and none", n, len(rest))
+	}
+}
+
+func TestGetFileStatSafeExtendedCount(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		b    []byte
+	}{
+		{"count beyond the data", marshal(nil, struct {
+			Count uint32
+			Type  string
+			Data  string
+		}{0xffffffff, "a", "b"})},
+		{"pair cut short", marshal(nil, struct {
+			Count uint32
+			Type  string
+			Data  string
+		}{1, "a", "b"})[:12]},
+		{"count missing", nil},
+	} {
+		if _, _, err := getFileStatSafe(sshFileXferAttrExtented, tt.b); err != errShortPacket {
+			t.Errorf("%s: got %v, want errShortPacket", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package sftp
+
+import (
+	"container/list"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// OpenCached opens the named file for reading through a cache of blockSize
+// sized blocks. Each block is fetched from the server the first time a ReadAt
+// touches it, and later ReadAts within it are served from memory, which for
+// many small reads close to each other saves most of the round trips. At most
+// MaxCachedBlocks blocks are kept, the least recently used being dropped
+// first. Changes made to the file on the server after a block was fetched are
+// not seen. The returned Closer closes the file.
+func (c *Client) OpenCached(path string, blockSize int) (io.ReaderAt, io.Closer, error) {
+	if blockSize < 1 {
+		return nil, nil, errors.Errorf("blockSize must be greater or equal to 1")
+	}
+	f, err := c.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	cf := &cachedFile{
+		f:         f,
+		blockSize: int64(blockSize),
+		maxBlocks: c.maxCachedBlocks,
+		blocks:    make(map[int64]*list.Element),
+		lru:       list.New(),
+	}
+	return cf, f, nil
+}
+
+// cachedFile is the io.ReaderAt returned by OpenCached.
+type cachedFile struct {
+	f         *File
+	blockSize int64
+	maxBlocks int
+
+	mu     sync.Mutex // protects blocks and lru
+	blocks map[int64]*list.Element
+	lru    *list.List // of *cachedBlock, most recently used first
+}
+
+type cachedBlock struct {
+	index int64
+	data  []byte // shorter than blockSize only for the last block of the file
+}
+
+func (cf *cachedFile) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.Errorf("negative offset %d", off)
+	}
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	var n int
+	for n < len(b) {
+		pos := off + int64(n)
+		data, err := cf.block(pos / cf.blockSize)
+		if err != nil {
+			return n, err
+		}
+		start := pos % cf.blockSize
+		if start >= int64(len(data)) {
+			return n, io.EOF
+		}
+		n += copy(b[n:], data[start:])
+		if int64(len(data)) < cf.blockSize && n < len(b) {
+			// the last block of the file has been used up
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// block returns the contents of block i, fetching it if it is not cached.
+func (cf *cachedFile) block(i int64) ([]byte, error) {
+	if e, ok := cf.blocks[i]; ok {
+		cf.lru.MoveToFront(e)
+		return e.Value.(*cachedBlock).data, nil
+	}
+	data := make([]byte, cf.blockSize)
+	n, err := cf.f.ReadAt(data, i*cf.blockSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	cf.blocks[i] = cf.lru.PushFront(&cachedBlock{index: i, data: data[:n]})
+	if cf.lru.Len() > cf.maxBlocks {
+		oldest := cf.lru.Remove(cf.lru.Back()).(*cachedBlock)
+		delete(cf.blocks, oldest.index)
+	}
+	return data[:n], nil
+}
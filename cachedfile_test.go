@@ -0,0 +1,103 @@
+package sftp
+
+import (
+	"bytes"
+	"encoding"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestClientOpenCached(t *testing.T) {
+	content := make([]byte, 3000)
+	for i := range content {
+		content[i] = byte(i * 13)
+	}
+	var reads int
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, data := unmarshalUint32(data)
+		switch typ {
+		case sshFxpOpen:
+			return sshFxpHandlePacket{ID: id, Handle: "h"}
+		case sshFxpRead:
+			reads++
+			_, data = unmarshalString(data)
+			offset, data := unmarshalUint64(data)
+			length, _ := unmarshalUint32(data)
+			if offset >= uint64(len(content)) {
+				return fakeStatus(id, sshFxEOF)
+			}
+			// copied, as marshalling the packet appends to Data
+			b := append([]byte(nil), content[offset:]...)
+			if len(b) > int(length) {
+				b = b[:length]
+			}
+			return &sshFxpDataPacket{ID: id, Length: uint32(len(b)), Data: b}
+		case sshFxpClose:
+			return fakeStatus(id, sshFxOk)
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	}, MaxCachedBlocks(2))
+	defer c.Close()
+
+	r, closer, err := c.OpenCached("/foo", 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	readAt := func(off int64, size int) (int, error) {
+		t.Helper()
+		b := make([]byte, size)
+		n, err := r.ReadAt(b, off)
+		end := int(off) + n
+		if !bytes.Equal(b[:n], content[off:end]) {
+			t.Errorf("ReadAt(%d, %d) returned the wrong data", off, size)
+		}
+		return n, err
+	}
+	checkReads := func(desc string, want int) {
+		t.Helper()
+		if reads != want {
+			t.Errorf("%s: %d READ requests in all, want %d", desc, reads, want)
+		}
+	}
+
+	// a read spanning blocks 0 and 1 fetches both
+	if n, err := readAt(1000, 100); n != 100 || err != nil {
+		t.Fatalf("ReadAt(1000, 100) = %d, %v", n, err)
+	}
+	checkReads("blocks 0 and 1", 2)
+
+	// anything inside them is served from the cache
+	readAt(0, 10)
+	readAt(1500, 500)
+	checkReads("cached blocks", 2)
+
+	// block 2 is the short last block; reading past the end gives io.EOF
+	if n, err := readAt(2900, 200); n != 100 || err != io.EOF {
+		t.Errorf("ReadAt(2900, 200) = %d, %v, want 100, %v", n, err, io.EOF)
+	}
+	reads2 := reads
+	if n, err := readAt(3000, 1); n != 0 || err != io.EOF {
+		t.Errorf("ReadAt(3000, 1) = %d, %v, want 0, %v", n, err, io.EOF)
+	}
+	checkReads("cached last block", reads2)
+
+	// only two blocks are kept: block 0 was used least recently and is gone
+	readAt(1024, 1)
+	checkReads("block 1 still cached", reads2)
+	readAt(0, 1)
+	checkReads("block 0 evicted", reads2+1)
+}
+
+func TestClientOpenCachedMissing(t *testing.T) {
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, _ := unmarshalUint32(data)
+		return fakeStatus(id, sshFxNoSuchFile)
+	})
+	defer c.Close()
+	if _, _, err := c.OpenCached("/missing", 1024); err != os.ErrNotExist {
+		t.Errorf("OpenCached of a missing file: want %v, got %v", os.ErrNotExist, err)
+	}
+}
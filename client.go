@@ -2,10 +2,15 @@ package sftp
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"io"
+	"net/http"
 	"os"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -27,6 +32,33 @@ var (
 	//
 	// Deprecated: please use ErrInternalInconsistency
 	InternalInconsistency = ErrInternalInconsistency
+	// ErrStreamDesynchronized is returned by all pending and later operations
+	// on a Client which has been shut down after receiving several packets in
+	// a row that were too short to be replies. This means the client and
+	// server no longer agree on where packets start and end, usually because
+	// something other than the SFTP server writes to the stream.
+	ErrStreamDesynchronized = errors.New("sftp: stream desynchronized")
+	// ErrDuplicateResponse is returned by all pending and later operations
+	// on a Client which has been shut down after the server sent a second
+	// reply to a request, a protocol violation after which no reply can be
+	// trusted to answer the request it claims to.
+	ErrDuplicateResponse = errors.New("sftp: duplicate response from server")
+	// ErrBadPath is returned when opening an empty path, which no server
+	// can resolve to a file.
+	ErrBadPath = errors.New("sftp: empty path")
+	// ErrClientClosed is returned by operations on a Client, or on its
+	// Files, after Client.Close has been called, including those which
+	// were still waiting for a reply when it was.
+	ErrClientClosed = errors.New("sftp: client closed")
+	// ErrTooManyLinks is returned by OpenResolved when following symbolic
+	// links takes too many hops, usually because of a loop.
+	ErrTooManyLinks = errors.New("sftp: too many levels of symbolic links")
+	// ErrFileTooLarge is returned by ReadFileLimit when the file holds more
+	// than the limit it was given.
+	ErrFileTooLarge = errors.New("sftp: file too large")
+	// ErrNameTooLong is returned, without asking the server, for a request
+	// naming a path longer than the limits set with MaxPathLength.
+	ErrNameTooLong = errors.New("sftp: file name too long")
 )
 
 // A ClientOption is a function which applies configuration to a Client.
@@ -76,6 +108,135 @@ func UseFstat(value bool) ClientOption {
 	}
 }
 
+// SymlinkArgOrder sets the order in which Symlink sends its two paths.
+//
+// The SFTP draft specifies the link path first and the target path second,
+// but OpenSSH has always sent and expected them the other way around, and as
+// most servers are OpenSSH or follow it, so does this package by default.
+// Pass true to use the order from the specification instead, for servers that
+// implement it to the letter; with such a server the symptom of the wrong
+// order is Symlink creating a link at oldname pointing to newname.
+func SymlinkArgOrder(standard bool) ClientOption {
+	return func(c *Client) error {
+		c.symlinkStandardOrder = standard
+		return nil
+	}
+}
+
+// MaxCachedBlocks sets the number of blocks a reader returned by OpenCached
+// keeps in memory, discarding the least recently used block beyond that.
+//
+// The default is 64 blocks.
+func MaxCachedBlocks(n int) ClientOption {
+	return func(c *Client) error {
+		if n < 1 {
+			return errors.Errorf("n must be greater or equal to 1")
+		}
+		c.maxCachedBlocks = n
+		return nil
+	}
+}
+
+// WithStatVFSCache makes StatVFS remember its results for ttl, so that asking
+// again within that time, for example to check the free space before each of
+// many uploads, costs no round trip.
+//
+// Results are remembered per path, and grouped by the filesystem id the
+// server returns: a fresh reply for any path on a filesystem also refreshes
+// the cached results of the other paths on it. Within ttl, changes on the
+// server, such as space freed by other clients, go unnoticed.
+func WithStatVFSCache(ttl time.Duration) ClientOption {
+	return func(c *Client) error {
+		if ttl <= 0 {
+			return errors.Errorf("ttl must be positive")
+		}
+		c.statVFSCache = &statVFSCache{
+			ttl:   ttl,
+			fsids: make(map[string]uint64),
+			byID:  make(map[uint64]statVFSEntry),
+		}
+		return nil
+	}
+}
+
+// WithNegativeStatCache makes Stat and Lstat remember for ttl that a path
+// does not exist, so that asking again within that time, as a walk looking
+// for sidecar files such as "foo.sha256" might, returns os.ErrNotExist
+// without a round trip.
+//
+// Creating a file, directory or link at the path through the client, or
+// renaming something onto it, forgets the entries for it and for the paths
+// below it. Within ttl, paths created on the server by other clients go
+// unnoticed.
+func WithNegativeStatCache(ttl time.Duration) ClientOption {
+	return func(c *Client) error {
+		if ttl <= 0 {
+			return errors.Errorf("ttl must be positive")
+		}
+		c.missingCache = &missingCache{
+			ttl:     ttl,
+			expires: make(map[missingKey]time.Time),
+		}
+		return nil
+	}
+}
+
+// A Logger receives the lines logged by a Client given WithLogger.
+// *log.Logger implements it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// LogLevel sets which operations a Client given WithLogger logs.
+type LogLevel int
+
+// The levels accepted by WithLogger.
+const (
+	LogErrors LogLevel = iota // only operations which failed
+	LogAll                    // every operation
+)
+
+// WithLogger makes the client log to l, at the given level, one line for each
+// operation it carries out on the server: its type, the path it acted on and
+// its result, such as "sftp: stat /tmp/foo: file does not exist". Reads and
+// writes are logged once per call rather than once per request sent. An
+// io.EOF result counts as success.
+//
+// Without a logger, which is the default, nothing is formatted and the cost
+// of logging is a nil check per operation.
+func WithLogger(l Logger, level LogLevel) ClientOption {
+	return func(c *Client) error {
+		c.logger = l
+		c.logLevel = level
+		return nil
+	}
+}
+
+// MkdirExistingOK makes Mkdir return nil, rather than the server's generic
+// failure, when the directory it was asked to create already exists, which it
+// checks with a Stat after the failure. By default Mkdir is strict, like
+// os.Mkdir. MkdirAll needs no such option.
+func MkdirExistingOK(ok bool) ClientOption {
+	return func(c *Client) error {
+		c.mkdirExistingOK = ok
+		return nil
+	}
+}
+
+// IdleTimeout makes the client close itself once no request has been sent
+// or answered for d, freeing the session on the server, for example when
+// clients are pooled. Operations after that return ErrClientClosed. A
+// request still waiting for its reply after d keeps the client open.
+func IdleTimeout(d time.Duration) ClientOption {
+	return func(c *Client) error {
+		if d <= 0 {
+			return errors.Errorf("d must be positive")
+		}
+		c.idleTimeout = d
+		return nil
+	}
+}
+
 // MaxPacketUnchecked sets the maximum size of the payload, measured in bytes.
 // It accepts sizes larger than the 32768 bytes all servers should support.
 // Only use a setting higher than 32768 if your application always connects to
@@ -107,6 +268,56 @@ func MaxPacket(size int) ClientOption {
 	return MaxPacketChecked(size)
 }
 
+// AlignReads makes the client ask the server for the block size of the
+// filesystem holding its working directory, with the statvfs@openssh.com
+// extension, when it connects, and then size the reads that ReadAt, WriteTo
+// and CopyFileRange split transfers into to the largest multiple of that block
+// size which fits in MaxPacket. If the server does not support the extension,
+// or its block size is larger than MaxPacket, reads stay MaxPacket sized.
+func AlignReads(value bool) ClientOption {
+	return func(c *Client) error {
+		c.alignReads = value
+		return nil
+	}
+}
+
+// defaultMaxPathLength is PATH_MAX on Linux, which few servers exceed.
+const defaultMaxPathLength = 4096
+
+// MaxPathLength sets the longest path, and the longest single name within a
+// path, in bytes, which the client will send to the server. A request naming
+// a longer one fails with ErrNameTooLong, rather than with whatever generic
+// failure the server would answer it with. No extension in common use lets
+// a server advertise its limits, so they must be set here; 0 leaves a limit
+// unchecked. By default paths are limited to 4096 bytes and names are not
+// checked.
+func MaxPathLength(path, name int) ClientOption {
+	return func(c *Client) error {
+		if path < 0 || name < 0 {
+			return errors.Errorf("sftp: negative MaxPathLength %d, %d", path, name)
+		}
+		c.maxPathLength = path
+		c.maxNameLength = name
+		return nil
+	}
+}
+
+// ReadRetries makes File.WriteTo send a read again, at the same offset, when
+// the server fails it with a generic failure or connection lost status, up to
+// n times for each read before giving up on the whole transfer, so that a
+// momentary problem on the server does not abort a long download. Replies
+// lost with the connection itself cannot be asked for again. By default,
+// reads are not retried.
+func ReadRetries(n int) ClientOption {
+	return func(c *Client) error {
+		if n < 0 {
+			return errors.Errorf("n must be greater or equal to 0")
+		}
+		c.readRetries = n
+		return nil
+	}
+}
+
 // MaxConcurrentRequestsPerFile sets the maximum concurrent requests allowed for a single file.
 //
 // The default maximum concurrent requests is 64.
@@ -127,6 +338,17 @@ func NewClient(conn *ssh.Client, opts ...ClientOption) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
+	return NewClientFromSession(s, opts...)
+}
+
+// NewClientFromSession creates a new SFTP client on an already established
+// session s, by requesting the "sftp" subsystem on it.
+//
+// Each session is its own channel with its own request ids and flow control,
+// so several Clients may share one *ssh.Client by opening a session per
+// Client. This lets independent workloads run in parallel without one
+// connection's in-flight window or a slow transfer holding up the others.
+func NewClientFromSession(s *ssh.Session, opts ...ClientOption) (*Client, error) {
 	if err := s.RequestSubsystem("sftp"); err != nil {
 		return nil, err
 	}
@@ -145,6 +367,10 @@ func NewClient(conn *ssh.Client, opts ...ClientOption) (*Client, error) {
 // NewClientPipe creates a new SFTP client given a Reader and a WriteCloser.
 // This can be used for connecting to an SFTP server over TCP/TLS or by using
 // the system's ssh client program (e.g. via exec.Command).
+//
+// If the version handshake fails, no Client is returned and wr is closed, so
+// that a half written INIT can never be followed by other packets on it. The
+// reader is not read past the failure; rd and wr should be discarded.
 func NewClientPipe(rd io.Reader, wr io.WriteCloser, opts ...ClientOption) (*Client, error) {
 	sftp := &Client{
 		clientConn: clientConn{
@@ -157,6 +383,8 @@ func NewClientPipe(rd io.Reader, wr io.WriteCloser, opts ...ClientOption) (*Clie
 		},
 		maxPacket:             1 << 15,
 		maxConcurrentRequests: 64,
+		maxCachedBlocks:       64,
+		maxPathLength:         defaultMaxPathLength,
 	}
 	if err := sftp.applyOptions(opts...); err != nil {
 		wr.Close()
@@ -170,8 +398,17 @@ func NewClientPipe(rd io.Reader, wr io.WriteCloser, opts ...ClientOption) (*Clie
 		wr.Close()
 		return nil, err
 	}
+	sftp.clientConn.closeOrphan = func(handle string) {
+		// recv cannot wait for the reply it would have to deliver itself
+		go sftp.close(handle)
+	}
+	sftp.clientConn.checkRequest = sftp.checkPaths
 	sftp.clientConn.wg.Add(1)
 	go sftp.loop()
+	if sftp.alignReads {
+		sftp.learnBlockSize()
+	}
+	sftp.startIdleTimer()
 	return sftp, nil
 }
 
@@ -184,9 +421,45 @@ type Client struct {
 	clientConn
 
 	maxPacket             int // max packet size read or written.
+	blockSize             int // of the server's filesystem, if AlignReads learnt it
 	nextid                uint32
 	maxConcurrentRequests int
 	useFstat              bool
+	symlinkStandardOrder  bool
+	mkdirExistingOK       bool
+	alignReads            bool
+	readRetries           int
+	maxCachedBlocks       int
+	maxPathLength         int // 0 if unchecked
+	maxNameLength         int // 0 if unchecked
+
+	statVFSCache *statVFSCache // nil unless WithStatVFSCache is used
+	missingCache *missingCache // nil unless WithNegativeStatCache is used
+
+	writeCalls callTracker // write calls still sending chunks, for Barrier
+	written    writtenSet  // open files written to since the last BarrierSync
+
+	logger   Logger // nil unless WithLogger is used
+	logLevel LogLevel
+
+	ext map[string]string // extensions advertised by the server
+}
+
+// logOp logs the result *errp of the operation op on p, if the client has a
+// logger. It takes a pointer so that it can be deferred before the result is
+// known.
+func (c *Client) logOp(op, p string, errp *error) {
+	if c.logger == nil {
+		return
+	}
+	err := *errp
+	if err == nil || err == io.EOF {
+		if c.logLevel >= LogAll {
+			c.logger.Printf("sftp: %s %s: ok", op, p)
+		}
+		return
+	}
+	c.logger.Printf("sftp: %s %s: %v", op, p, err)
 }
 
 // Create creates the named file mode 0666 (before umask), truncating it if it
@@ -197,10 +470,31 @@ type Client struct {
 // Note that some SFTP servers (eg. AWS Transfer) do not support opening files
 // read/write at the same time. For those services you will need to use
 // `client.OpenFile(os.O_WRONLY|os.O_CREATE|os.O_TRUNC)`.
+//
+// If the parent directory of path does not exist the returned error is an
+// *os.PathError naming path, for which os.IsNotExist is true.
 func (c *Client) Create(path string) (*File, error) {
 	return c.open(path, flags(os.O_RDWR|os.O_CREATE|os.O_TRUNC))
 }
 
+// CreateModeChecked is like Create, but asks the server to give the file the
+// permission bits of perm if it creates it, and returns the mode the file
+// actually ended up with, which is read back from the open file. Servers
+// usually apply their umask to perm, and some ignore it altogether, so the
+// two may differ; callers which need perm exactly can then Chmod the file.
+func (c *Client) CreateModeChecked(path string, perm os.FileMode) (*File, os.FileMode, error) {
+	f, err := c.openAttrs(path, flags(os.O_RDWR|os.O_CREATE|os.O_TRUNC), sshFileXferAttrPermissions, uint32(perm.Perm()))
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Mode(), nil
+}
+
 const sftpProtocolVersion = 3 // http://tools.ietf.org/html/draft-ietf-secsh-filexfer-02
 
 func (c *Client) sendInit() error {
@@ -209,6 +503,94 @@ func (c *Client) sendInit() error {
 	})
 }
 
+// learnBlockSize sets c.blockSize from the statvfs of the working
+// directory, if the server supports statvfs@openssh.com. Failure leaves it
+// unset.
+func (c *Client) learnBlockSize() {
+	if _, ok := c.HasExtension("statvfs@openssh.com"); !ok {
+		return
+	}
+	vfs, err := c.StatVFS(".")
+	if err != nil {
+		return
+	}
+	bs := vfs.Frsize
+	if bs == 0 {
+		bs = vfs.Bsize
+	}
+	if bs > 0 && bs <= uint64(c.maxPacket) {
+		c.blockSize = int(bs)
+	}
+}
+
+// readSize returns the size of the reads transfers are split into.
+func (c *Client) readSize() int {
+	if c.blockSize == 0 {
+		return c.maxPacket
+	}
+	return c.maxPacket - c.maxPacket%c.blockSize
+}
+
+// checkPaths fails with ErrNameTooLong if any of the paths named by the
+// request p is longer than MaxPathLength allows.
+func (c *Client) checkPaths(p idmarshaler) error {
+	if c.maxPathLength == 0 && c.maxNameLength == 0 {
+		return nil
+	}
+	for _, name := range requestPaths(p) {
+		if c.maxPathLength > 0 && len(name) > c.maxPathLength {
+			return ErrNameTooLong
+		}
+		if c.maxNameLength > 0 {
+			for _, elem := range strings.Split(name, "/") {
+				if len(elem) > c.maxNameLength {
+					return ErrNameTooLong
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// requestPaths returns the paths named by the request p, if any.
+func requestPaths(p idmarshaler) []string {
+	switch p := p.(type) {
+	case sshFxpOpenPacket:
+		return []string{p.Path}
+	case sshFxpStatPacket:
+		return []string{p.Path}
+	case sshFxpLstatPacket:
+		return []string{p.Path}
+	case sshFxpOpendirPacket:
+		return []string{p.Path}
+	case sshFxpMkdirPacket:
+		return []string{p.Path}
+	case sshFxpRmdirPacket:
+		return []string{p.Path}
+	case sshFxpRemovePacket:
+		return []string{p.Filename}
+	case sshFxpReadlinkPacket:
+		return []string{p.Path}
+	case sshFxpRealpathPacket:
+		return []string{p.Path}
+	case sshFxpSetstatPacket:
+		return []string{p.Path}
+	case sshFxpStatvfsPacket:
+		return []string{p.Path}
+	case sshFxpCheckFileNamePacket:
+		return []string{p.Path}
+	case sshFxpRenamePacket:
+		return []string{p.Oldpath, p.Newpath}
+	case sshFxpPosixRenamePacket:
+		return []string{p.Oldpath, p.Newpath}
+	case sshFxpHardlinkPacket:
+		return []string{p.Oldpath, p.Newpath}
+	case sshFxpSymlinkPacket:
+		return []string{p.Targetpath, p.Linkpath}
+	}
+	return nil
+}
+
 // returns the next value of c.nextid
 func (c *Client) nextID() uint32 {
 	return atomic.AddUint32(&c.nextid, 1)
@@ -216,21 +598,250 @@ func (c *Client) nextID() uint32 {
 
 func (c *Client) recvVersion() error {
 	typ, data, err := c.recvPacket(0)
-	if err != nil {
+	if err == errShortPacket || err == errLongPacket {
 		return err
 	}
+	if err != nil {
+		return &TransportError{Op: "receive", Err: err}
+	}
 	if typ != sshFxpVersion {
 		return &unexpectedPacketErr{sshFxpVersion, typ}
 	}
 
-	version, _ := unmarshalUint32(data)
+	version, data := unmarshalUint32(data)
 	if version != sftpProtocolVersion {
 		return &unexpectedVersionErr{sftpProtocolVersion, version}
 	}
 
+	c.ext = make(map[string]string)
+	for len(data) > 0 {
+		var ext extensionPair
+		ext, data, err = unmarshalExtensionPair(data)
+		if err != nil {
+			return err
+		}
+		c.ext[ext.Name] = ext.Data
+	}
+
 	return nil
 }
 
+// HasExtension checks whether the server supports a named extension.
+//
+// The first return value is the extension data reported by the server
+// (typically a version number).
+func (c *Client) HasExtension(name string) (string, bool) {
+	data, ok := c.ext[name]
+	return data, ok
+}
+
+// ServerVendor returns the product name and version the server reports in
+// its vendor-id extension, as described in
+// https://tools.ietf.org/html/draft-ietf-secsh-filexfer-13#section-4.4, for
+// diagnostics and for working around the quirks of known servers. ok is false
+// if the server sent no vendor-id, or one that could not be parsed.
+func (c *Client) ServerVendor() (name, version string, ok bool) {
+	data, ok := c.HasExtension("vendor-id")
+	if !ok {
+		data, ok = c.HasExtension("vendor-id@openssh.com")
+	}
+	if !ok {
+		return "", "", false
+	}
+	b := []byte(data)
+	// the vendor name comes first, then the product name and version, and
+	// last a build number, which is left out
+	_, b, err := unmarshalStringSafe(b)
+	if err != nil {
+		return "", "", false
+	}
+	if name, b, err = unmarshalStringSafe(b); err != nil {
+		return "", "", false
+	}
+	if version, _, err = unmarshalStringSafe(b); err != nil {
+		return "", "", false
+	}
+	return name, version, true
+}
+
+// Flush blocks until every packet the client has started sending has been
+// written to the underlying transport, and flushes the transport if it has
+// a Flush method. It does not wait for any responses, so it only orders
+// sends; use it to be sure a batch of pipelined requests is on the wire
+// before doing something else.
+func (c *Client) Flush() error {
+	return c.clientConn.conn.flush()
+}
+
+// Barrier blocks until every request sent before it was called, on any of
+// the client's files, has been answered, so that writes still in flight from
+// other goroutines have all been acknowledged by the server when it returns.
+// A write call which splits its data into several requests, such as a large
+// File.Write, ReadFrom, CopyFileRange or WriteFileMulti, and which was
+// running when Barrier was called, is waited for as a whole, including the
+// requests it sends afterwards. Other requests sent after Barrier is called
+// are not waited for, although those sent while it waits for such a call may
+// be. An acknowledgement does not mean the data is on stable storage; use
+// BarrierSync for that. Barrier returns the error which shut the session down
+// if it ends first.
+func (c *Client) Barrier() error {
+	c.writeCalls.wait()
+	return c.clientConn.waitAnswered()
+}
+
+// BarrierSync is like Barrier, but then also asks the server to flush each
+// file which is still open and has been written to since the last
+// BarrierSync to stable storage, with the fsync@openssh.com extension. The
+// flushes are pipelined. Files closed in the meantime are not flushed, nor
+// are those written by WriteFileMulti, which closes them itself. If the server
+// lacks the extension, BarrierSync fails without waiting; otherwise the
+// errors for the files which could not be flushed are returned together as a
+// MultiError, and those files are flushed again by the next BarrierSync.
+func (c *Client) BarrierSync() error {
+	if _, ok := c.HasExtension("fsync@openssh.com"); !ok {
+		return &StatusError{Code: sshFxOPUnsupported, msg: "fsync@openssh.com not supported by the server"}
+	}
+	if err := c.Barrier(); err != nil {
+		return err
+	}
+	files := c.written.take()
+	reqs := make(map[uint32]*File)
+	var errs MultiError
+	fail := func(f *File, err error) {
+		c.written.add(f)
+		errs = append(errs, &os.PathError{Op: "sync", Path: f.path, Err: err})
+	}
+	var next int
+	connErr := c.pipeline(func() (idmarshaler, bool) {
+		for next < len(files) && atomic.LoadInt32(&files[next].closed) != 0 {
+			next++ // closed since it was taken
+		}
+		if next == len(files) {
+			return nil, false
+		}
+		f := files[next]
+		next++
+		id := c.nextID()
+		reqs[id] = f
+		return sshFxpFsyncPacket{ID: id, Handle: f.handle}, true
+	}, func(id uint32, typ byte, data []byte, err error) {
+		f := reqs[id]
+		delete(reqs, id)
+		switch {
+		case err != nil:
+			fail(f, err)
+		case typ == sshFxpStatus:
+			if err := normaliseError(unmarshalStatus(id, data)); err != nil {
+				fail(f, err)
+			}
+		default:
+			fail(f, unimplementedPacketErr(typ))
+		}
+	})
+	if connErr != nil {
+		// the flushes not answered are left to a later BarrierSync
+		for _, f := range reqs {
+			c.written.add(f)
+		}
+		return connErr
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// writtenSet is the set of open files written to, for BarrierSync. The zero
+// value is ready to use.
+type writtenSet struct {
+	mu    sync.Mutex
+	files map[*File]struct{}
+}
+
+// add records that f has been written to. It is done when a write starts, so
+// that a BarrierSync waiting for the write flushes f afterwards.
+func (s *writtenSet) add(f *File) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files == nil {
+		s.files = make(map[*File]struct{})
+	}
+	s.files[f] = struct{}{}
+}
+
+// remove forgets f, once it is closed.
+func (s *writtenSet) remove(f *File) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, f)
+}
+
+// take empties the set and returns the files which were in it.
+func (s *writtenSet) take() []*File {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files := make([]*File, 0, len(s.files))
+	for f := range s.files {
+		files = append(files, f)
+	}
+	s.files = nil
+	return files
+}
+
+// callTracker keeps track of the calls in progress, so that Barrier can wait
+// for those which started before it. The zero value is ready to use.
+type callTracker struct {
+	mu         sync.Mutex
+	done       *sync.Cond
+	last       uint64              // ticket of the latest call started
+	inProgress map[uint64]struct{} // tickets of the calls not yet ended
+}
+
+// start records the start of a call, and returns the ticket to end it with.
+func (t *callTracker) start() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.inProgress == nil {
+		t.inProgress = make(map[uint64]struct{})
+	}
+	t.last++
+	t.inProgress[t.last] = struct{}{}
+	return t.last
+}
+
+// end records the end of the call given ticket by start.
+func (t *callTracker) end(ticket uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.inProgress, ticket)
+	if t.done != nil {
+		t.done.Broadcast()
+	}
+}
+
+// wait blocks until every call started before it has ended.
+func (t *callTracker) wait() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done == nil {
+		t.done = sync.NewCond(&t.mu)
+	}
+	mark := t.last
+	for {
+		pending := false
+		for ticket := range t.inProgress {
+			if ticket <= mark {
+				pending = true
+				break
+			}
+		}
+		if !pending {
+			return
+		}
+		t.done.Wait()
+	}
+}
+
 // Walk returns a new Walker rooted at root.
 func (c *Client) Walk(root string) *fs.Walker {
 	return fs.WalkFS(root, c)
@@ -239,54 +850,175 @@ func (c *Client) Walk(root string) *fs.Walker {
 // ReadDir reads the directory named by dirname and returns a list of
 // directory entries.
 func (c *Client) ReadDir(p string) ([]os.FileInfo, error) {
+	var attrs []os.FileInfo
+	err := c.ReadDirStream(p, func(fi os.FileInfo) error {
+		attrs = append(attrs, fi)
+		return nil
+	})
+	return attrs, err
+}
+
+// ReadDirSorted is like ReadDir, but returns the entries sorted by name, as
+// os.ReadDir does, rather than in the order the server sent them.
+func (c *Client) ReadDirSorted(p string) ([]os.FileInfo, error) {
+	attrs, err := c.ReadDir(p)
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Name() < attrs[j].Name() })
+	return attrs, err
+}
+
+// ErrStopReadDir can be returned by the function passed to ReadDirStream to
+// stop reading the directory early. ReadDirStream itself then returns nil.
+var ErrStopReadDir = errors.New("sftp: stop reading directory")
+
+// ReadDirStream reads the directory named by p and calls fn for each entry
+// as it is received from the server, so unlike ReadDir the whole listing is
+// never held in memory at once. If fn returns an error the listing stops;
+// ReadDirStream returns nil if that error is ErrStopReadDir, and the error
+// itself otherwise.
+//
+// Listing a path which is not a directory fails with an *os.PathError
+// holding syscall.ENOTDIR, whether the server refuses to open it or opens it
+// and then fails to read it.
+func (c *Client) ReadDirStream(p string, fn func(os.FileInfo) error) (err error) {
+	defer c.logOp("readdir", p, &err)
 	handle, err := c.opendir(p)
 	if err != nil {
-		return nil, err
+		return c.notDirError(p, err)
 	}
 	defer c.close(handle) // this has to defer earlier than the lock below
-	var attrs []os.FileInfo
-	var done = false
-	for !done {
-		id := c.nextID()
-		typ, data, err1 := c.sendPacket(sshFxpReaddirPacket{
-			ID:     id,
-			Handle: handle,
-		})
-		if err1 != nil {
-			err = err1
-			done = true
-			break
+	for first := true; ; first = false {
+		batch, err := c.ReadDirContinue(handle)
+		if err == io.EOF {
+			return nil
 		}
-		switch typ {
-		case sshFxpName:
-			sid, data := unmarshalUint32(data)
-			if sid != id {
-				return nil, &unexpectedIDErr{id, sid}
+		if err != nil {
+			if first {
+				return c.notDirError(p, err)
 			}
-			count, data := unmarshalUint32(data)
-			for i := uint32(0); i < count; i++ {
-				var filename string
-				filename, data = unmarshalString(data)
-				_, data = unmarshalString(data) // discard longname
-				var attr *FileStat
-				attr, data = unmarshalAttrs(data)
-				if filename == "." || filename == ".." {
-					continue
+			return err
+		}
+		for _, fi := range batch {
+			if err := fn(fi); err != nil {
+				if err == ErrStopReadDir {
+					return nil
 				}
-				attrs = append(attrs, fileInfoFromStat(attr, path.Base(filename)))
+				return err
 			}
-		case sshFxpStatus:
-			// TODO(dfc) scope warning!
-			err = normaliseError(unmarshalStatus(id, data))
-			done = true
-		default:
-			return nil, unimplementedPacketErr(typ)
 		}
 	}
-	if err == io.EOF {
-		err = nil
+}
+
+// notDirError returns the error for a listing of p which failed with err: an
+// ENOTDIR *os.PathError if p is not a directory, and err otherwise. As most
+// servers only report a generic failure, a Stat of p tells.
+func (c *Client) notDirError(p string, err error) error {
+	serr, ok := err.(*StatusError)
+	if !ok {
+		return err
 	}
-	return attrs, err
+	if serr.Code != sshFxNotADirectory {
+		if fi, statErr := c.stat(p); statErr != nil || fi.IsDir() {
+			return err
+		}
+	}
+	return &os.PathError{Op: "readdir", Path: p, Err: syscall.ENOTDIR}
+}
+
+// OpenDir opens the directory p for listing with ReadDirContinue, and
+// returns the raw handle the server gave it. The handle must be closed with
+// CloseDir. Most callers want ReadDir or ReadDirStream instead.
+func (c *Client) OpenDir(p string) (handle string, err error) {
+	defer c.logOp("opendir", p, &err)
+	return c.opendir(p)
+}
+
+// CloseDir closes a directory handle returned by OpenDir.
+func (c *Client) CloseDir(handle string) error {
+	return c.close(handle)
+}
+
+// ReadDirContinue reads the next batch of entries from the directory handle
+// returned by OpenDir, in a single round trip; the server chooses how many
+// entries a batch holds. It returns io.EOF once the listing is complete.
+//
+// A caller listing a huge directory can remember the names it has been
+// given, and should the connection be lost, open the directory again on a
+// new Client and carry on, skipping the names already seen. This is
+// inherently racy: entries created or removed in the meantime may be missed
+// or reported although gone, and a server may list entries in a different
+// order each time, so the whole listing has to be read again and filtered,
+// not skipped by count.
+func (c *Client) ReadDirContinue(handle string) ([]os.FileInfo, error) {
+	id := c.nextID()
+	typ, data, err := c.sendPacket(sshFxpReaddirPacket{
+		ID:     id,
+		Handle: handle,
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case sshFxpName:
+		sid, data := unmarshalUint32(data)
+		if sid != id {
+			return nil, &unexpectedIDErr{id, sid}
+		}
+		count, data, err := unmarshalNameCount(data)
+		if err != nil {
+			return nil, err
+		}
+		batch := make([]os.FileInfo, 0, count)
+		for i := uint32(0); i < count; i++ {
+			var filename string
+			var flags uint32
+			if filename, data, err = unmarshalStringSafe(data); err != nil {
+				return nil, err
+			}
+			if _, data, err = unmarshalStringSafe(data); err != nil { // discard longname
+				return nil, err
+			}
+			if flags, data, err = unmarshalUint32Safe(data); err != nil {
+				return nil, err
+			}
+			var attr *FileStat
+			if attr, data, err = getFileStatSafe(flags, data); err != nil {
+				return nil, err
+			}
+			if filename == "." || filename == ".." {
+				continue
+			}
+			batch = append(batch, fileInfoFromStat(attr, path.Base(filename)))
+		}
+		return batch, nil
+	case sshFxpStatus:
+		err := normaliseError(unmarshalStatus(id, data))
+		if err == nil {
+			// an OK status ends the listing just as well
+			err = io.EOF
+		}
+		return nil, err
+	default:
+		return nil, unimplementedPacketErr(typ)
+	}
+}
+
+// minNameEntrySize is the size of an entry of an SSH_FXP_NAME reply with an
+// empty name and long name, and no attributes.
+const minNameEntrySize = 4 + 4 + 4
+
+// unmarshalNameCount reads the count of entries at the start of the body of
+// an SSH_FXP_NAME reply, and checks that the rest of b can hold that many,
+// so that a bad count cannot make the client allocate for entries which are
+// not there.
+func unmarshalNameCount(b []byte) (uint32, []byte, error) {
+	count, b, err := unmarshalUint32Safe(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	if uint64(count)*minNameEntrySize > uint64(len(b)) {
+		return 0, nil, errShortPacket
+	}
+	return count, b, nil
 }
 
 func (c *Client) opendir(path string) (string, error) {
@@ -315,7 +1047,18 @@ func (c *Client) opendir(path string) (string, error) {
 
 // Stat returns a FileInfo structure describing the file specified by path 'p'.
 // If 'p' is a symbolic link, the returned FileInfo structure describes the referent file.
-func (c *Client) Stat(p string) (os.FileInfo, error) {
+func (c *Client) Stat(p string) (fi os.FileInfo, err error) {
+	defer c.logOp("stat", p, &err)
+	return c.stat(p)
+}
+
+// stat is Stat without the logging, for the Stats the client makes itself to
+// find out why something failed or whether a path exists, where a missing
+// path is no error worth logging.
+func (c *Client) stat(p string) (os.FileInfo, error) {
+	if c.missingCache.has(p, false) {
+		return nil, os.ErrNotExist
+	}
 	id := c.nextID()
 	typ, data, err := c.sendPacket(sshFxpStatPacket{
 		ID:   id,
@@ -333,7 +1076,11 @@ func (c *Client) Stat(p string) (os.FileInfo, error) {
 		attr, _ := unmarshalAttrs(data)
 		return fileInfoFromStat(attr, path.Base(p)), nil
 	case sshFxpStatus:
-		return nil, normaliseError(unmarshalStatus(id, data))
+		err := normaliseError(unmarshalStatus(id, data))
+		if err == os.ErrNotExist {
+			c.missingCache.put(p, false)
+		}
+		return nil, err
 	default:
 		return nil, unimplementedPacketErr(typ)
 	}
@@ -341,32 +1088,157 @@ func (c *Client) Stat(p string) (os.FileInfo, error) {
 
 // Lstat returns a FileInfo structure describing the file specified by path 'p'.
 // If 'p' is a symbolic link, the returned FileInfo structure describes the symbolic link.
-func (c *Client) Lstat(p string) (os.FileInfo, error) {
+func (c *Client) Lstat(p string) (fi os.FileInfo, err error) {
+	defer c.logOp("lstat", p, &err)
+	return c.lstat(p)
+}
+
+// lstat is Lstat without the logging, as stat is for Stat.
+func (c *Client) lstat(p string) (os.FileInfo, error) {
+	_, attr, err := c.lstatAttrs(p)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfoFromStat(attr, path.Base(p)), nil
+}
+
+// lstatAttrs is like lstat, but returns the attributes as sent, with the
+// flags saying which of them the server reported.
+func (c *Client) lstatAttrs(p string) (uint32, *FileStat, error) {
+	if c.missingCache.has(p, true) {
+		return 0, nil, os.ErrNotExist
+	}
 	id := c.nextID()
 	typ, data, err := c.sendPacket(sshFxpLstatPacket{
 		ID:   id,
 		Path: p,
 	})
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 	switch typ {
 	case sshFxpAttrs:
 		sid, data := unmarshalUint32(data)
 		if sid != id {
-			return nil, &unexpectedIDErr{id, sid}
+			return 0, nil, &unexpectedIDErr{id, sid}
 		}
-		attr, _ := unmarshalAttrs(data)
-		return fileInfoFromStat(attr, path.Base(p)), nil
+		flags, data := unmarshalUint32(data)
+		attr, _ := getFileStat(flags, data)
+		return flags, attr, nil
 	case sshFxpStatus:
-		return nil, normaliseError(unmarshalStatus(id, data))
+		err := normaliseError(unmarshalStatus(id, data))
+		if err == os.ErrNotExist {
+			c.missingCache.put(p, true)
+		}
+		return 0, nil, err
 	default:
-		return nil, unimplementedPacketErr(typ)
+		return 0, nil, unimplementedPacketErr(typ)
+	}
+}
+
+// StatMany returns the Lstat results for each of paths, with the FileInfo
+// or the error for paths[i] at index i of the returned slices. The requests
+// are pipelined, up to the per-file concurrency limit at a time, which is
+// much faster than calling Lstat in turn over a high latency link.
+func (c *Client) StatMany(paths []string) ([]os.FileInfo, []error) {
+	infos := make([]os.FileInfo, len(paths))
+	errs := make([]error, len(paths))
+	reqs := make(map[uint32]int)
+	var next int
+	connErr := c.pipeline(func() (idmarshaler, bool) {
+		if next == len(paths) {
+			return nil, false
+		}
+		id := c.nextID()
+		reqs[id] = next
+		next++
+		return sshFxpLstatPacket{ID: id, Path: paths[next-1]}, true
+	}, func(id uint32, typ byte, data []byte, err error) {
+		i := reqs[id]
+		delete(reqs, id)
+		switch {
+		case err != nil:
+			errs[i] = err
+		case typ == sshFxpAttrs:
+			_, data = unmarshalUint32(data)
+			attr, _ := unmarshalAttrs(data)
+			infos[i] = fileInfoFromStat(attr, path.Base(paths[i]))
+		case typ == sshFxpStatus:
+			errs[i] = normaliseError(unmarshalStatus(id, data))
+		default:
+			errs[i] = unimplementedPacketErr(typ)
+		}
+	})
+	if connErr != nil {
+		for i := range paths {
+			if infos[i] == nil && errs[i] == nil {
+				errs[i] = connErr
+			}
+		}
+	}
+	return infos, errs
+}
+
+// pipeline sends the requests returned by next, keeping up to the per-file
+// concurrency limit of them in flight, until next has nothing more to send
+// and every request sent has been answered. Each reply is handed to reply
+// with the id of its request, and the whole of the packet as sendPacket
+// returns it. A request whose paths fail checkPaths is not sent, and is
+// handed to reply with that error instead.
+//
+// next and reply are called from the calling goroutine only, so next may
+// depend on the replies so far; returning false only means there is nothing
+// to send until another reply comes. Should the connection fail, nothing more
+// is sent, and the error is returned once the requests in flight have been
+// accounted for. It does not say which requests it belongs to, so it is left
+// to the caller to hand it to those it did not see answered.
+func (c *Client) pipeline(next func() (idmarshaler, bool), reply func(id uint32, typ byte, data []byte, err error)) error {
+	// maxConcurrentRequests buffer to deal with broadcastErr() floods
+	ch := make(chan result, c.maxConcurrentRequests+1)
+	inFlight := make(map[uint32]struct{})
+	var failed int // requests in flight when the connection failed
+	var connErr error
+	for {
+		for len(inFlight) < c.maxConcurrentRequests && connErr == nil {
+			pkt, ok := next()
+			if !ok {
+				break
+			}
+			if err := c.checkPaths(pkt); err != nil {
+				// only connection errors may come back on ch
+				reply(pkt.id(), 0, nil, err)
+				continue
+			}
+			inFlight[pkt.id()] = struct{}{}
+			c.dispatchRequest(ch, pkt)
+		}
+		if len(inFlight) == failed {
+			return connErr
+		}
+		res := <-ch
+		if res.err != nil {
+			// errors from the connection don't say which request they
+			// belong to, so just count them off
+			connErr = res.err
+			failed++
+			continue
+		}
+		sid, _ := unmarshalUint32(res.data)
+		if _, ok := inFlight[sid]; !ok {
+			if connErr == nil {
+				connErr = errors.Errorf("sid: %v not found", sid)
+			}
+			failed++
+			continue
+		}
+		delete(inFlight, sid)
+		reply(sid, res.typ, res.data, nil)
 	}
 }
 
 // ReadLink reads the target of a symbolic link.
-func (c *Client) ReadLink(p string) (string, error) {
+func (c *Client) ReadLink(p string) (target string, err error) {
+	defer c.logOp("readlink", p, &err)
 	id := c.nextID()
 	typ, data, err := c.sendPacket(sshFxpReadlinkPacket{
 		ID:   id,
@@ -381,12 +1253,7 @@ func (c *Client) ReadLink(p string) (string, error) {
 		if sid != id {
 			return "", &unexpectedIDErr{id, sid}
 		}
-		count, data := unmarshalUint32(data)
-		if count != 1 {
-			return "", unexpectedCount(1, count)
-		}
-		filename, _ := unmarshalString(data) // ignore dummy attributes
-		return filename, nil
+		return unmarshalLinkTarget(data)
 	case sshFxpStatus:
 		return "", normaliseError(unmarshalStatus(id, data))
 	default:
@@ -394,8 +1261,120 @@ func (c *Client) ReadLink(p string) (string, error) {
 	}
 }
 
+// unmarshalLinkTarget decodes the target from the body of the
+// SSH_FXP_NAME reply to a readlink, following the request id.
+func unmarshalLinkTarget(data []byte) (string, error) {
+	count, data, err := unmarshalNameCount(data)
+	if err != nil {
+		return "", err
+	}
+	if count != 1 {
+		return "", unexpectedCount(1, count)
+	}
+	filename, _, err := unmarshalStringSafe(data) // ignore dummy attributes
+	return filename, err
+}
+
+// ReadLinkMany reads the targets of each of paths, with the target or the
+// error for paths[i] at index i of the returned slices. As with StatMany,
+// the requests are pipelined, up to the per-file concurrency limit at a
+// time, which makes reading a tree full of symbolic links much faster over a
+// high latency link.
+func (c *Client) ReadLinkMany(paths []string) ([]string, []error) {
+	targets := make([]string, len(paths))
+	errs := make([]error, len(paths))
+	answered := make([]bool, len(paths))
+	reqs := make(map[uint32]int)
+	var next int
+	connErr := c.pipeline(func() (idmarshaler, bool) {
+		if next == len(paths) {
+			return nil, false
+		}
+		id := c.nextID()
+		reqs[id] = next
+		next++
+		return sshFxpReadlinkPacket{ID: id, Path: paths[next-1]}, true
+	}, func(id uint32, typ byte, data []byte, err error) {
+		i := reqs[id]
+		delete(reqs, id)
+		answered[i] = true
+		switch {
+		case err != nil:
+			errs[i] = err
+		case typ == sshFxpName:
+			_, data = unmarshalUint32(data)
+			targets[i], errs[i] = unmarshalLinkTarget(data)
+		case typ == sshFxpStatus:
+			errs[i] = normaliseError(unmarshalStatus(id, data))
+		default:
+			errs[i] = unimplementedPacketErr(typ)
+		}
+	})
+	if connErr != nil {
+		for i := range paths {
+			if !answered[i] {
+				errs[i] = connErr
+			}
+		}
+	}
+	return targets, errs
+}
+
+// maxLinkHops is the number of symbolic links OpenResolved follows, as
+// MAXSYMLINKS on Linux.
+const maxLinkHops = 40
+
+// OpenResolved opens the file p for reading, like Open, but follows symbolic
+// links on the client, with Lstat and ResolveLink, rather than leaving it to
+// the server, for servers whose SSH_FXP_OPEN does not follow them as the
+// caller expects. It returns ErrTooManyLinks if more than 40 links are met,
+// as they are in a loop. Only a link at the end of the path is followed;
+// links among the directories leading to it are left to the server.
+func (c *Client) OpenResolved(p string) (*File, error) {
+	for hops := 0; ; hops++ {
+		fi, err := c.Lstat(p)
+		if err != nil {
+			return nil, err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return c.Open(p)
+		}
+		if hops == maxLinkHops {
+			return nil, ErrTooManyLinks
+		}
+		if p, err = c.ResolveLink(p); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// ResolveLink reads the target of the symbolic link p and returns it as a
+// clean absolute path. A relative target is taken relative to the directory
+// containing the link, and a relative p relative to the working directory.
+// Only p itself is resolved; if the target is another link it is not
+// followed.
+func (c *Client) ResolveLink(p string) (string, error) {
+	target, err := c.ReadLink(p)
+	if err != nil {
+		return "", err
+	}
+	if !path.IsAbs(target) {
+		target = path.Join(path.Dir(p), target)
+	}
+	if !path.IsAbs(target) {
+		wd, err := c.Getwd()
+		if err != nil {
+			return "", err
+		}
+		target = path.Join(wd, target)
+	}
+	return path.Clean(target), nil
+}
+
 // Link creates a hard link at 'newname', pointing at the same inode as 'oldname'
-func (c *Client) Link(oldname, newname string) error {
+func (c *Client) Link(oldname, newname string) (err error) {
+	defer c.logOp("link", newname, &err)
+	c.missingCache.forget(newname)
 	id := c.nextID()
 	typ, data, err := c.sendPacket(sshFxpHardlinkPacket{
 		ID:      id,
@@ -414,13 +1393,20 @@ func (c *Client) Link(oldname, newname string) error {
 }
 
 // Symlink creates a symbolic link at 'newname', pointing at target 'oldname'
-func (c *Client) Symlink(oldname, newname string) error {
+func (c *Client) Symlink(oldname, newname string) (err error) {
+	defer c.logOp("symlink", newname, &err)
+	c.missingCache.forget(newname)
 	id := c.nextID()
-	typ, data, err := c.sendPacket(sshFxpSymlinkPacket{
+	p := sshFxpSymlinkPacket{
 		ID:         id,
 		Linkpath:   newname,
 		Targetpath: oldname,
-	})
+	}
+	if c.symlinkStandardOrder {
+		// sshFxpSymlinkPacket is laid out in the OpenSSH order
+		p.Linkpath, p.Targetpath = p.Targetpath, p.Linkpath
+	}
+	typ, data, err := c.sendPacket(p)
 	if err != nil {
 		return err
 	}
@@ -452,7 +1438,8 @@ func (c *Client) setfstat(handle string, flags uint32, attrs interface{}) error
 }
 
 // setstat is a convience wrapper to allow for changing of various parts of the file descriptor.
-func (c *Client) setstat(path string, flags uint32, attrs interface{}) error {
+func (c *Client) setstat(path string, flags uint32, attrs interface{}) (err error) {
+	defer c.logOp("setstat", path, &err)
 	id := c.nextID()
 	typ, data, err := c.sendPacket(sshFxpSetstatPacket{
 		ID:    id,
@@ -481,6 +1468,105 @@ func (c *Client) Chtimes(path string, atime time.Time, mtime time.Time) error {
 	return c.setstat(path, sshFileXferAttrACmodTime, attrs)
 }
 
+// Touch creates the named file if it does not exist, like the touch command.
+// If it already exists its access and modification times are set to the
+// current time instead; its contents are left as they are.
+func (c *Client) Touch(path string) error {
+	_, err := c.stat(path)
+	switch {
+	case err == os.ErrNotExist:
+		f, err := c.open(path, flags(os.O_WRONLY|os.O_CREATE))
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	case err != nil:
+		return err
+	}
+	now := time.Now()
+	return c.Chtimes(path, now, now)
+}
+
+// SameFile reports whether fi1 and fi2 describe the same file, like
+// os.SameFile, for FileInfos returned by this package.
+//
+// Version 3 of the protocol gives no inode or file id to compare, so this is
+// a heuristic: the files must have the same name, size, mode, owner and
+// modification time, and the same extended attributes if the server sends
+// any, which for some servers carry an identifier. Two distinct files which
+// agree on all of these, to the second, are reported the same, and hard
+// links to one file under different names are reported different. FileInfos
+// not from this package are never the same.
+func (c *Client) SameFile(fi1, fi2 os.FileInfo) bool {
+	st1, ok1 := fi1.Sys().(*FileStat)
+	st2, ok2 := fi2.Sys().(*FileStat)
+	if !ok1 || !ok2 {
+		return false
+	}
+	if fi1.Name() != fi2.Name() || st1.Size != st2.Size || st1.Mode != st2.Mode ||
+		st1.Mtime != st2.Mtime || st1.UID != st2.UID || st1.GID != st2.GID {
+		return false
+	}
+	if len(st1.Extended) != len(st2.Extended) {
+		return false
+	}
+	for i := range st1.Extended {
+		if st1.Extended[i] != st2.Extended[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// largeFileOffset is where CheckLargeFileSupport writes its test byte; it is
+// past 4GB so that a server keeping only the low 32 bits of offsets is caught.
+const largeFileOffset = 5 << 30
+
+// CheckLargeFileSupport reports whether the server correctly handles file
+// offsets which do not fit in 32 bits, as a few old servers silently truncate
+// them. It creates path, which must not already exist, writes a single byte
+// at an offset of 5GB and reads it back, and removes path again afterwards.
+// Only a few bytes cross the wire, but path may take up 5GB on a server
+// without sparse file support.
+func (c *Client) CheckLargeFileSupport(path string) (ok bool, err error) {
+	f, err := c.open(path, flags(os.O_RDWR|os.O_CREATE|os.O_EXCL))
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		cerr := f.Close()
+		if rerr := c.Remove(path); cerr == nil {
+			cerr = rerr
+		}
+		if err == nil {
+			err = cerr
+		}
+	}()
+
+	want := []byte{0x5a}
+	if _, err := f.Seek(largeFileOffset, io.SeekStart); err != nil {
+		return false, err
+	}
+	if _, err := f.Write(want); err != nil {
+		return false, err
+	}
+	got := make([]byte, len(want))
+	switch _, err := f.ReadAt(got, largeFileOffset); err {
+	case nil:
+	case io.EOF:
+		return false, nil
+	default:
+		return false, err
+	}
+	// a server truncating both the write and the read offset hands back the
+	// byte, but the file size gives it away
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	return got[0] == want[0] && fi.Size() == largeFileOffset+int64(len(want)), nil
+}
+
 // Chown changes the user and group owners of the named file.
 func (c *Client) Chown(path string, uid, gid int) error {
 	type owner struct {
@@ -491,11 +1577,199 @@ func (c *Client) Chown(path string, uid, gid int) error {
 	return c.setstat(path, sshFileXferAttrUIDGID, attrs)
 }
 
+// CopyAttrs sets the permissions, owner and group, and access and
+// modification times of dst to those of src, as Lstat reports them, in a
+// single SETSTAT request rather than one each for Chmod, Chown and Chtimes.
+// Attributes the server does not report for src are left unchanged on dst.
+// The server may refuse the change of owner to anyone but root.
+//
+// A src which is a symbolic link is refused: SETSTAT follows dst if it is
+// a link, so the link's own attributes would end up on whatever it resolves
+// to.
+func (c *Client) CopyAttrs(src, dst string) error {
+	flags, st, err := c.lstatAttrs(src)
+	if err != nil {
+		return err
+	}
+	if flags&sshFileXferAttrPermissions != 0 && toFileMode(st.Mode)&os.ModeSymlink != 0 {
+		return errors.Errorf("sftp: %s is a symbolic link", src)
+	}
+	flags &= sshFileXferAttrUIDGID | sshFileXferAttrPermissions | sshFileXferAttrACmodTime
+	if flags == 0 {
+		return errors.Errorf("sftp: no attributes for %s", src)
+	}
+	// in the order SETSTAT carries them
+	var attrs []uint32
+	if flags&sshFileXferAttrUIDGID != 0 {
+		attrs = append(attrs, st.UID, st.GID)
+	}
+	if flags&sshFileXferAttrPermissions != 0 {
+		attrs = append(attrs, st.Mode&07777)
+	}
+	if flags&sshFileXferAttrACmodTime != 0 {
+		attrs = append(attrs, st.Atime, st.Mtime)
+	}
+	return c.setstat(dst, flags, attrs)
+}
+
 // Chmod changes the permissions of the named file.
 func (c *Client) Chmod(path string, mode os.FileMode) error {
 	return c.setstat(path, sshFileXferAttrPermissions, uint32(mode))
 }
 
+// ChmodAll changes the permissions of root and everything below it, setting
+// directories to dirMode and regular files to fileMode. Symbolic links are
+// not followed and are left unchanged.
+//
+// ChmodAll does not stop at the first failure; every entry is attempted and
+// the errors encountered are returned together as a MultiError. Directories
+// are changed after their contents so that a restrictive dirMode does not
+// prevent the walk from descending into them.
+func (c *Client) ChmodAll(root string, dirMode, fileMode os.FileMode) error {
+	var errs MultiError
+	var dirs []string
+	walker := c.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		fi := walker.Stat()
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			// leave links, and whatever they point at, alone
+		case fi.IsDir():
+			dirs = append(dirs, walker.Path())
+		case fi.Mode().IsRegular():
+			if err := c.Chmod(walker.Path(), fileMode); err != nil {
+				errs = append(errs, &os.PathError{Op: "chmod", Path: walker.Path(), Err: err})
+			}
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := c.Chmod(dirs[i], dirMode); err != nil {
+			errs = append(errs, &os.PathError{Op: "chmod", Path: dirs[i], Err: err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// StatTree walks the tree rooted at root and returns the FileInfo of every
+// file and directory in it, keyed by path, each path starting with root as
+// with Walk. The FileInfos come from the directory listings, so the whole
+// tree costs one READDIR round trip per directory rather than one stat per
+// file, and later lookups need no round trip at all. Symbolic links are not
+// followed, and are described as links.
+//
+// The map holds the whole tree in memory, which for a tree of millions of
+// files can be a lot; use Walk to visit such trees piece by piece.
+func (c *Client) StatTree(root string) (map[string]os.FileInfo, error) {
+	tree := make(map[string]os.FileInfo)
+	walker := c.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, err
+		}
+		tree[walker.Path()] = walker.Stat()
+	}
+	return tree, nil
+}
+
+// WalkSkipErrors walks the tree rooted at root like Walk, calling fn for each
+// file or directory, but does not stop on errors: a directory which cannot be
+// read, for lack of permission for example, is skipped and the walk carries on
+// with the rest of the tree. The errors met along the way are returned, as
+// *os.PathError, in the order they were met.
+func (c *Client) WalkSkipErrors(root string, fn func(path string, fi os.FileInfo)) []error {
+	var errs []error
+	walker := c.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			op := "readdir"
+			if walker.Stat() == nil {
+				op = "lstat"
+			}
+			errs = append(errs, &os.PathError{Op: op, Path: walker.Path(), Err: err})
+			continue
+		}
+		fn(walker.Path(), walker.Stat())
+	}
+	return errs
+}
+
+// A WalkEntry is a node of the tree walked by WalkChan.
+type WalkEntry struct {
+	Path string
+	Info os.FileInfo
+}
+
+// WalkChan walks the tree rooted at root, in the order Walk does, and sends
+// an entry for each file and directory in it on the first channel returned.
+// The walk stops at the first error, which is sent on the second channel, or
+// once ctx is done, in which case ctx.Err() is. Both channels are closed once
+// the walk has stopped, the error channel after the entries one, and without
+// an error sent on it if the whole tree was walked.
+func (c *Client) WalkChan(ctx context.Context, root string) (<-chan WalkEntry, <-chan error) {
+	entries := make(chan WalkEntry)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		defer close(entries)
+		walker := c.Walk(root)
+		for walker.Step() {
+			if err := ctx.Err(); err != nil {
+				errc <- err
+				return
+			}
+			if err := walker.Err(); err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case entries <- WalkEntry{Path: walker.Path(), Info: walker.Stat()}:
+			case <-ctx.Done():
+				errc <- ctx.Err()
+				return
+			}
+		}
+	}()
+	return entries, errc
+}
+
+// DirSize returns the total size in bytes of the regular files in the tree
+// rooted at root. Sizes are taken from the directory listings, so no file is
+// stat'ed individually. Symbolic links are not followed, and count for the
+// size the server reports for the link itself.
+func (c *Client) DirSize(root string) (int64, error) {
+	var size int64
+	walker := c.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return size, err
+		}
+		fi := walker.Stat()
+		if fi.Mode().IsRegular() || fi.Mode()&os.ModeSymlink != 0 {
+			size += fi.Size()
+		}
+	}
+	return size, nil
+}
+
+// MultiError is returned by operations that process many paths and carry on
+// past individual failures. It holds every error encountered, in order.
+type MultiError []error
+
+func (m MultiError) Error() string {
+	msgs := make([]string, len(m))
+	for i, err := range m {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
 // Truncate sets the size of the named file. Although it may be safely assumed
 // that if the size is less than its current size it will be truncated to fit,
 // the SFTP protocol does not specify what behavior the server should do when setting
@@ -511,22 +1785,228 @@ func (c *Client) Open(path string) (*File, error) {
 	return c.open(path, flags(os.O_RDONLY))
 }
 
-// OpenFile is the generalized open call; most users will use Open or
-// Create instead. It opens the named file with specified flag (O_RDONLY
-// etc.). If successful, methods on the returned File can be used for I/O.
-func (c *Client) OpenFile(path string, f int) (*File, error) {
-	return c.open(path, flags(f))
+// Head returns the first n bytes of the named file, or all of it if it is
+// shorter, for example to sniff its content type. The file is opened with
+// OpenAndStat, so that the size of a regular file is known without an extra
+// round trip and no more is asked for than it holds: at most one read request
+// is sent for each maxPacket bytes of n. A negative n is an error.
+func (c *Client) Head(path string, n int) ([]byte, error) {
+	if n < 0 {
+		return nil, errors.Errorf("sftp: Head of %d bytes", n)
+	}
+	f, fi, err := c.OpenAndStat(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if fi.Mode().IsRegular() && fi.Size() < int64(n) {
+		n = int(fi.Size())
+	}
+	b := make([]byte, n)
+	read, err := f.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return b[:read], nil
+}
+
+// ContentType returns the MIME type of the named file, as guessed by
+// http.DetectContentType from its first 512 bytes, which are read with Head.
+// An empty file is "application/octet-stream".
+func (c *Client) ContentType(path string) (string, error) {
+	b, err := c.Head(path, 512)
+	if err != nil {
+		return "", err
+	}
+	if len(b) == 0 {
+		return "application/octet-stream", nil
+	}
+	return http.DetectContentType(b), nil
+}
+
+// ReadFileLimit returns the contents of the named file, read with the
+// pipelined reads of WriteTo, or ErrFileTooLarge if it holds more than max
+// bytes. The limit is checked against the bytes actually received, not the
+// size the server reports, so that neither a file growing as it is read nor a
+// server lying about its size can make the client hold more than max bytes.
+func (c *Client) ReadFileLimit(path string, max int64) ([]byte, error) {
+	f, err := c.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	w := &limitedBuffer{max: max}
+	if _, err := f.WriteTo(w); err != nil {
+		return nil, err
+	}
+	return w.buf.Bytes(), nil
+}
+
+// limitedBuffer is a bytes.Buffer refusing writes past max bytes.
+type limitedBuffer struct {
+	buf bytes.Buffer
+	max int64
+}
+
+func (w *limitedBuffer) Write(b []byte) (int, error) {
+	if int64(w.buf.Len())+int64(len(b)) > w.max {
+		return 0, ErrFileTooLarge
+	}
+	return w.buf.Write(b)
+}
+
+// OpenAndStat opens the file p for reading, like Open, and returns its
+// FileInfo too, in a single round trip. An FSTAT cannot be sent until the
+// OPEN reply brings the handle, so a STAT of p is sent right behind the
+// OPEN instead. The two therefore only describe the same file as long as
+// nothing replaces p in between. If the STAT fails, the file is closed
+// again and the error returned.
+func (c *Client) OpenAndStat(name string) (*File, os.FileInfo, error) {
+	p, err := cleanOpenPath(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	pflags := flags(os.O_RDONLY)
+	openID, statID := c.nextID(), c.nextID()
+	openCh, statCh := make(chan result, 1), make(chan result, 1)
+	c.dispatchRequest(openCh, sshFxpOpenPacket{
+		ID:     openID,
+		Path:   p,
+		Pflags: pflags,
+	})
+	c.dispatchRequest(statCh, sshFxpStatPacket{
+		ID:   statID,
+		Path: p,
+	})
+
+	s := <-openCh
+	f, err := c.openReply(openID, name, p, pflags, s.typ, s.data, s.err)
+	s = <-statCh
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.err != nil {
+		f.Close()
+		return nil, nil, s.err
+	}
+	switch s.typ {
+	case sshFxpAttrs:
+		sid, data := unmarshalUint32(s.data)
+		if sid != statID {
+			f.Close()
+			return nil, nil, &unexpectedIDErr{statID, sid}
+		}
+		attr, _ := unmarshalAttrs(data)
+		return f, fileInfoFromStat(attr, path.Base(p)), nil
+	case sshFxpStatus:
+		err = normaliseError(unmarshalStatus(statID, s.data))
+	default:
+		err = unimplementedPacketErr(s.typ)
+	}
+	f.Close()
+	return nil, nil, err
+}
+
+// OpenFile is the generalized open call; most users will use Open or
+// Create instead. It opens the named file with specified flag (O_RDONLY
+// etc.). If successful, methods on the returned File can be used for I/O.
+//
+// Only O_RDONLY, O_WRONLY, O_RDWR, O_APPEND, O_CREATE, O_TRUNC and O_EXCL
+// can be passed on to the server, and OpenFile returns an error naming any
+// other flag set in f rather than silently ignoring it. The exception is
+// O_SYNC, which makes each write on the file wait for an fsync of it, and is
+// accepted when the server supports the fsync@openssh.com extension. Note
+// that SFTP has no text mode: files are always transferred as is, with no
+// line ending translation. OpenFile, like Open and Create, returns
+// ErrBadPath for an empty path without asking the server, and drops a
+// leading "./" from path.
+func (c *Client) OpenFile(path string, f int) (*File, error) {
+	if err := c.checkFlags(f); err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	file, err := c.open(path, flags(f))
+	if err != nil {
+		return nil, err
+	}
+	file.sync = f&os.O_SYNC != 0
+	return file, nil
+}
+
+// OpenFileContext is like OpenFile, but gives up waiting for the server to
+// reply once ctx is done, returning ctx.Err(). Should the handle arrive after
+// that, it is closed, so that no file is left open on the server.
+func (c *Client) OpenFileContext(ctx context.Context, name string, f int) (*File, error) {
+	if err := c.checkFlags(f); err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	path, err := cleanOpenPath(name)
+	if err != nil {
+		return nil, err
+	}
+	pflags := flags(f)
+	c.missingCache.forget(path)
+	id := c.nextID()
+	typ, data, err := c.sendRequestWithCancel(sshFxpOpenPacket{
+		ID:     id,
+		Path:   path,
+		Pflags: pflags,
+	}, ctx.Done())
+	if err == errRequestCancelled {
+		return nil, ctx.Err()
+	}
+	file, err := c.openReply(id, name, path, pflags, typ, data, err)
+	if err != nil {
+		return nil, err
+	}
+	file.sync = f&os.O_SYNC != 0
+	return file, nil
+}
+
+func (c *Client) open(path string, pflags uint32) (*File, error) {
+	return c.openAttrs(path, pflags, 0, nil)
 }
 
-func (c *Client) open(path string, pflags uint32) (*File, error) {
+// openAttrs is like open, but also sends the attributes attrs, as named by
+// flags, which a server may apply to a file it creates.
+func (c *Client) openAttrs(name string, pflags, flags uint32, attrs interface{}) (*File, error) {
+	path, err := cleanOpenPath(name)
+	if err != nil {
+		return nil, err
+	}
+	c.missingCache.forget(path)
 	id := c.nextID()
 	typ, data, err := c.sendPacket(sshFxpOpenPacket{
 		ID:     id,
 		Path:   path,
 		Pflags: pflags,
+		Flags:  flags,
+		Attrs:  attrs,
 	})
-	if err != nil {
-		return nil, err
+	return c.openReply(id, name, path, pflags, typ, data, err)
+}
+
+// cleanOpenPath checks that p is not empty, and removes any leading "./"
+// from it, as a shell would, so that "./foo" opens the same file as "foo"
+// whatever the server makes of the dot.
+func cleanOpenPath(p string) (string, error) {
+	if p == "" {
+		return "", ErrBadPath
+	}
+	for strings.HasPrefix(p, "./") {
+		p = strings.TrimLeft(p[1:], "/")
+	}
+	if p == "" {
+		return ".", nil
+	}
+	return p, nil
+}
+
+// openReply interprets the server's reply to the OPEN request id, for the
+// file name as given by the caller, which was sent cleaned as path.
+func (c *Client) openReply(id uint32, name, path string, pflags uint32, typ byte, data []byte, sendErr error) (f *File, err error) {
+	defer c.logOp("open", name, &err)
+	if sendErr != nil {
+		return nil, sendErr
 	}
 	switch typ {
 	case sshFxpHandle:
@@ -535,14 +2015,39 @@ func (c *Client) open(path string, pflags uint32) (*File, error) {
 			return nil, &unexpectedIDErr{id, sid}
 		}
 		handle, _ := unmarshalString(data)
-		return &File{c: c, path: path, handle: handle}, nil
+		f := &File{c: c, name: name, path: path, handle: handle, pflags: pflags}
+		if pflags&sshFxfAppend != 0 {
+			// not every server ignores the offsets of writes in append
+			// mode, so start them at the end; a server which cannot say
+			// where that is is left to find it itself
+			if fs, err := c.fstat(handle); err == nil {
+				f.offset = fs.Size
+			}
+		}
+		return f, nil
 	case sshFxpStatus:
-		return nil, normaliseError(unmarshalStatus(id, data))
+		err := normaliseError(unmarshalStatus(id, data))
+		if err == os.ErrNotExist && pflags&sshFxfCreat != 0 {
+			err = c.checkParentExists(name, err)
+		}
+		return nil, err
 	default:
 		return nil, unimplementedPacketErr(typ)
 	}
 }
 
+// checkParentExists is called when creating p failed with err because
+// something does not exist. If a Stat confirms that it is the parent
+// directory which is missing, an *os.PathError naming p is returned, as a
+// bare "file does not exist" is confusing when asking for a file to be
+// created. Otherwise err is returned unchanged.
+func (c *Client) checkParentExists(p string, err error) error {
+	if _, serr := c.stat(path.Dir(p)); serr == os.ErrNotExist {
+		return &os.PathError{Op: "create", Path: p, Err: os.ErrNotExist}
+	}
+	return err
+}
+
 // close closes a handle handle previously returned in the response
 // to SSH_FXP_OPEN or SSH_FXP_OPENDIR. The handle becomes invalid
 // immediately after this request has been sent.
@@ -581,7 +2086,12 @@ func (c *Client) fstat(handle string) (*FileStat, error) {
 		attr, _ := unmarshalAttrs(data)
 		return attr, nil
 	case sshFxpStatus:
-		return nil, normaliseError(unmarshalStatus(id, data))
+		err := normaliseError(unmarshalStatus(id, data))
+		if err == nil {
+			// an OK status carries no attributes
+			err = unimplementedPacketErr(typ)
+		}
+		return nil, err
 	default:
 		return nil, unimplementedPacketErr(typ)
 	}
@@ -592,6 +2102,12 @@ func (c *Client) fstat(handle string) (*FileStat, error) {
 // It implements the statvfs@openssh.com SSH_FXP_EXTENDED feature
 // from http://www.opensource.apple.com/source/OpenSSH/OpenSSH-175/openssh/PROTOCOL?txt.
 func (c *Client) StatVFS(path string) (*StatVFS, error) {
+	if c.statVFSCache != nil {
+		if vfs, ok := c.statVFSCache.get(path); ok {
+			return vfs, nil
+		}
+	}
+
 	// send the StatVFS packet to the server
 	id := c.nextID()
 	typ, data, err := c.sendPacket(sshFxpStatvfsPacket{
@@ -610,6 +2126,9 @@ func (c *Client) StatVFS(path string) (*StatVFS, error) {
 		if err != nil {
 			return nil, errors.New("can not parse reply")
 		}
+		if c.statVFSCache != nil {
+			c.statVFSCache.put(path, response)
+		}
 
 		return &response, nil
 
@@ -622,6 +2141,110 @@ func (c *Client) StatVFS(path string) (*StatVFS, error) {
 	}
 }
 
+// statVFSCache holds the StatVFS results for WithStatVFSCache.
+type statVFSCache struct {
+	ttl time.Duration
+
+	mu    sync.Mutex
+	fsids map[string]uint64 // filesystem id of each path asked for
+	byID  map[uint64]statVFSEntry
+}
+
+type statVFSEntry struct {
+	vfs     StatVFS
+	expires time.Time
+}
+
+// get returns a copy of the cached result for the filesystem holding path,
+// if there is one and it has not expired.
+func (sc *statVFSCache) get(path string) (*StatVFS, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	fsid, ok := sc.fsids[path]
+	if !ok {
+		return nil, false
+	}
+	e, ok := sc.byID[fsid]
+	if !ok || !time.Now().Before(e.expires) {
+		return nil, false
+	}
+	vfs := e.vfs
+	return &vfs, true
+}
+
+func (sc *statVFSCache) put(path string, vfs StatVFS) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.fsids[path] = vfs.Fsid
+	sc.byID[vfs.Fsid] = statVFSEntry{vfs: vfs, expires: time.Now().Add(sc.ttl)}
+}
+
+// missingCache holds the paths Stat and Lstat found missing, for
+// WithNegativeStatCache. Its methods do nothing on a nil *missingCache.
+type missingCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	expires map[missingKey]time.Time
+}
+
+// missingKey keeps the entries of Stat and Lstat apart: a dangling symlink
+// is missing to Stat, but not to Lstat.
+type missingKey struct {
+	path  string
+	lstat bool
+}
+
+// has reports whether p was found missing less than ttl ago, by Lstat if
+// lstat is set. A path missing to Lstat is missing to Stat too.
+func (mc *missingCache) has(p string, lstat bool) bool {
+	if mc == nil {
+		return false
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	p = path.Clean(p)
+	if mc.hasKey(missingKey{p, true}) {
+		return true
+	}
+	return !lstat && mc.hasKey(missingKey{p, false})
+}
+
+func (mc *missingCache) hasKey(k missingKey) bool {
+	expires, ok := mc.expires[k]
+	if ok && !time.Now().Before(expires) {
+		delete(mc.expires, k)
+		return false
+	}
+	return ok
+}
+
+func (mc *missingCache) put(p string, lstat bool) {
+	if mc == nil {
+		return
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.expires[missingKey{path.Clean(p), lstat}] = time.Now().Add(mc.ttl)
+}
+
+// forget drops p, which is about to be created, and any path below it, as a
+// directory renamed or linked onto p may bring them into existence.
+func (mc *missingCache) forget(p string) {
+	if mc == nil {
+		return
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	p = path.Clean(p)
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	for k := range mc.expires {
+		if k.path == p || strings.HasPrefix(k.path, prefix) {
+			delete(mc.expires, k)
+		}
+	}
+}
+
 // Join joins any number of path elements into a single path, adding a
 // separating slash if necessary. The result is Cleaned; in particular, all
 // empty strings are ignored.
@@ -643,7 +2266,8 @@ func (c *Client) Remove(path string) error {
 	return err
 }
 
-func (c *Client) removeFile(path string) error {
+func (c *Client) removeFile(path string) (err error) {
+	defer c.logOp("remove", path, &err)
 	id := c.nextID()
 	typ, data, err := c.sendPacket(sshFxpRemovePacket{
 		ID:       id,
@@ -661,7 +2285,8 @@ func (c *Client) removeFile(path string) error {
 }
 
 // RemoveDirectory removes a directory path.
-func (c *Client) RemoveDirectory(path string) error {
+func (c *Client) RemoveDirectory(path string) (err error) {
+	defer c.logOp("rmdir", path, &err)
 	id := c.nextID()
 	typ, data, err := c.sendPacket(sshFxpRmdirPacket{
 		ID:   id,
@@ -679,7 +2304,9 @@ func (c *Client) RemoveDirectory(path string) error {
 }
 
 // Rename renames a file.
-func (c *Client) Rename(oldname, newname string) error {
+func (c *Client) Rename(oldname, newname string) (err error) {
+	defer c.logOp("rename", oldname, &err)
+	c.missingCache.forget(newname)
 	id := c.nextID()
 	typ, data, err := c.sendPacket(sshFxpRenamePacket{
 		ID:      id,
@@ -697,9 +2324,128 @@ func (c *Client) Rename(oldname, newname string) error {
 	}
 }
 
+// RenameMkdirAll renames oldname to newname like Rename, first creating any
+// missing parent directories of newname as MkdirAll does. It never replaces
+// an existing newname, and directories it created are left in place if the
+// rename itself fails.
+func (c *Client) RenameMkdirAll(oldname, newname string) error {
+	if dir := path.Dir(newname); dir != "." && dir != "/" {
+		if err := c.MkdirAll(dir); err != nil {
+			return err
+		}
+	}
+	return c.Rename(oldname, newname)
+}
+
+// Move moves the regular file oldname to newname, even when they are on
+// different filesystems of the server, where Rename fails. It tries Rename
+// first. If that fails with a generic failure, which is all that version 3 of
+// the protocol returns for a cross-device rename, and newname does not exist,
+// it copies oldname to newname through the client instead, sets the mode and
+// times of the copy to those of oldname, and removes oldname.
+//
+// Unlike Rename, the fallback is not atomic: other clients can see newname
+// while it is only partly written, and both names while the copy is
+// complete but oldname not yet removed. If the copy fails, what was written
+// of newname is removed again and oldname is left in place.
+func (c *Client) Move(oldname, newname string) error {
+	err := c.Rename(oldname, newname)
+	if serr, ok := err.(*StatusError); !ok || serr.Code != sshFxFailure {
+		return err
+	}
+	fi, lerr := c.lstat(oldname)
+	if lerr != nil || !fi.Mode().IsRegular() {
+		return err
+	}
+	if _, lerr := c.lstat(newname); lerr != os.ErrNotExist {
+		// the rename failed because newname exists, or for an unknown reason
+		return err
+	}
+	if err := c.copyFile(oldname, newname, fi); err != nil {
+		return err
+	}
+	return c.Remove(oldname)
+}
+
+// copyFile copies the file src, described by fi, to the new file dst, and
+// gives it the mode and times of src. If it fails once dst has been created,
+// dst is removed again.
+func (c *Client) copyFile(src, dst string, fi os.FileInfo) (err error) {
+	sf, err := c.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+	df, err := c.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		// dst is not ours to remove, whether it exists or not
+		return err
+	}
+	defer func() {
+		if err != nil {
+			c.Remove(dst)
+		}
+	}()
+	if _, err := io.Copy(df, sf); err != nil {
+		df.Close()
+		return err
+	}
+	if err := df.Close(); err != nil {
+		return err
+	}
+	if err := c.Chmod(dst, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	atime := fi.ModTime()
+	if st, ok := fi.Sys().(*FileStat); ok {
+		atime = time.Unix(int64(st.Atime), 0)
+	}
+	return c.Chtimes(dst, atime, fi.ModTime())
+}
+
+// Swap exchanges the files, or directories, a and b, with three renames: a to
+// a temporary name next to it, b to a, and the temporary name to b. The
+// first never replaces anything, so that an unlucky clash with the temporary
+// name fails rather than losing a file; the other two use PosixRename when
+// the server supports it.
+//
+// SFTP has no way to swap two names atomically. Between the renames, other
+// clients can see a missing, or b missing, or b under the temporary name. If
+// a rename fails, the earlier ones are undone, so that a and b are left as
+// they were, unless undoing fails too.
+func (c *Client) Swap(a, b string) error {
+	tmp := a + ".swap-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	if err := c.Rename(a, tmp); err != nil {
+		return err
+	}
+	if err := c.replace(b, a); err != nil {
+		c.replace(tmp, a)
+		return err
+	}
+	if err := c.replace(tmp, b); err != nil {
+		if c.replace(a, b) == nil {
+			c.replace(tmp, a)
+		}
+		return err
+	}
+	return nil
+}
+
+// replace renames oldname to newname with PosixRename, which replaces
+// newname if it exists, if the server supports it, and with Rename
+// otherwise.
+func (c *Client) replace(oldname, newname string) error {
+	if _, ok := c.HasExtension("posix-rename@openssh.com"); ok {
+		return c.PosixRename(oldname, newname)
+	}
+	return c.Rename(oldname, newname)
+}
+
 // PosixRename renames a file using the posix-rename@openssh.com extension
 // which will replace newname if it already exists.
-func (c *Client) PosixRename(oldname, newname string) error {
+func (c *Client) PosixRename(oldname, newname string) (err error) {
+	defer c.logOp("posix-rename", oldname, &err)
+	c.missingCache.forget(newname)
 	id := c.nextID()
 	typ, data, err := c.sendPacket(sshFxpPosixRenamePacket{
 		ID:      id,
@@ -732,12 +2478,15 @@ func (c *Client) realpath(path string) (string, error) {
 		if sid != id {
 			return "", &unexpectedIDErr{id, sid}
 		}
-		count, data := unmarshalUint32(data)
+		count, data, err := unmarshalNameCount(data)
+		if err != nil {
+			return "", err
+		}
 		if count != 1 {
 			return "", unexpectedCount(1, count)
 		}
-		filename, _ := unmarshalString(data) // ignore attributes
-		return filename, nil
+		filename, _, err := unmarshalStringSafe(data) // ignore attributes
+		return filename, err
 	case sshFxpStatus:
 		return "", normaliseError(unmarshalStatus(id, data))
 	default:
@@ -754,7 +2503,9 @@ func (c *Client) Getwd() (string, error) {
 // Mkdir creates the specified directory. An error will be returned if a file or
 // directory with the specified path already exists, or if the directory's
 // parent folder does not exist (the method cannot create complete paths).
-func (c *Client) Mkdir(path string) error {
+func (c *Client) Mkdir(path string) (err error) {
+	defer c.logOp("mkdir", path, &err)
+	c.missingCache.forget(path)
 	id := c.nextID()
 	typ, data, err := c.sendPacket(sshFxpMkdirPacket{
 		ID:   id,
@@ -765,7 +2516,15 @@ func (c *Client) Mkdir(path string) error {
 	}
 	switch typ {
 	case sshFxpStatus:
-		return normaliseError(unmarshalStatus(id, data))
+		err := normaliseError(unmarshalStatus(id, data))
+		if serr, ok := err.(*StatusError); ok && serr.Code == sshFxFailure && c.mkdirExistingOK {
+			// servers only say the mkdir failed; see whether it was
+			// because the directory is already there
+			if fi, statErr := c.stat(path); statErr == nil && fi.IsDir() {
+				return nil
+			}
+		}
+		return err
 	default:
 		return unimplementedPacketErr(typ)
 	}
@@ -778,7 +2537,7 @@ func (c *Client) Mkdir(path string) error {
 func (c *Client) MkdirAll(path string) error {
 	// Most of this code mimics https://golang.org/src/os/path.go?s=514:561#L13
 	// Fast path: if we can tell whether path is a directory or file, stop with success or error.
-	dir, err := c.Stat(path)
+	dir, err := c.stat(path)
 	if err == nil {
 		if dir.IsDir() {
 			return nil
@@ -810,7 +2569,7 @@ func (c *Client) MkdirAll(path string) error {
 	if err != nil {
 		// Handle arguments like "foo/." by
 		// double-checking that directory doesn't exist.
-		dir, err1 := c.Lstat(path)
+		dir, err1 := c.lstat(path)
 		if err1 == nil && dir.IsDir() {
 			return nil
 		}
@@ -819,6 +2578,49 @@ func (c *Client) MkdirAll(path string) error {
 	return nil
 }
 
+// RemoveEmptyDirs removes every directory in the tree rooted at root which
+// is empty, or becomes empty once the empty directories below it have been
+// removed, working bottom-up, and returns the paths of those it removed.
+// Files, and links to directories, are left alone and keep the directories
+// holding them. root itself is only removed if it was empty to begin with.
+// On error, the directories removed so far are returned with it.
+func (c *Client) RemoveEmptyDirs(root string) ([]string, error) {
+	var removed []string
+	_, err := c.removeEmptyDirs(root, true, &removed)
+	return removed, err
+}
+
+// removeEmptyDirs removes the empty directories below dir, and dir itself if
+// it is then empty and either it is not the root or it was empty at the
+// start. It reports whether it removed dir.
+func (c *Client) removeEmptyDirs(dir string, isRoot bool, removed *[]string) (bool, error) {
+	fis, err := c.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	left := len(fis)
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			continue
+		}
+		gone, err := c.removeEmptyDirs(path.Join(dir, fi.Name()), false, removed)
+		if err != nil {
+			return false, err
+		}
+		if gone {
+			left--
+		}
+	}
+	if left > 0 || (isRoot && len(fis) > 0) {
+		return false, nil
+	}
+	if err := c.RemoveDirectory(dir); err != nil {
+		return false, err
+	}
+	*removed = append(*removed, dir)
+	return true, nil
+}
+
 // applyOptions applies options functions to the Client.
 // If an error is encountered, option processing ceases.
 func (c *Client) applyOptions(opts ...ClientOption) error {
@@ -832,23 +2634,125 @@ func (c *Client) applyOptions(opts ...ClientOption) error {
 
 // File represents a remote file.
 type File struct {
+	// first, so that its uint64 fields are aligned for atomic operations
+	stats FileStats
+
 	c      *Client
-	path   string
+	name   string // as presented to Open
+	path   string // name as sent to the server
 	handle string
+	pflags uint32 // ssh flags the file was opened with
+	sync   bool   // opened with O_SYNC, so every write is followed by Sync
 
 	mu     sync.Mutex
 	offset uint64 // current offset within remote file
+
+	closeMu sync.RWMutex // held for reading by WriteTo while it sends reads, for writing by Close
+	closed  int32        // set atomically by Close to stop WriteTo
+
+	limit rateLimiter // set by SetRateLimit
+}
+
+// SetRateLimit limits the transfers of ReadAt, Read, WriteTo, Write and
+// ReadFrom on f to about bytesPerSec bytes per second, for example for a
+// sync running in the background. Bytes are counted as the server confirms
+// them, by returning them or acknowledging their write, and each call then
+// waits as long as needed before carrying on, so that outstanding requests
+// cannot make for a burst. A bytesPerSec of 0 or less removes the limit. It
+// is safe to call while transfers are running.
+func (f *File) SetRateLimit(bytesPerSec int64) {
+	f.limit.set(bytesPerSec)
+}
+
+// rateLimiter paces transfers to a number of bytes per second. It is a token
+// bucket which holds no tokens: every byte has to be waited for.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int64     // bytes per second, 0 when unlimited
+	next time.Time // when the bytes confirmed so far have been paid for
+}
+
+func (l *rateLimiter) set(rate int64) {
+	if rate < 0 {
+		rate = 0
+	}
+	l.mu.Lock()
+	l.rate = rate
+	l.mu.Unlock()
+}
+
+// wait blocks until n more bytes have been paid for.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	d := l.next.Sub(now)
+	l.mu.Unlock()
+	time.Sleep(d)
 }
 
 // Close closes the File, rendering it unusable for I/O. It returns an
 // error, if any.
-func (f *File) Close() error {
+//
+// A WriteTo running concurrently stops issuing reads and returns
+// os.ErrClosed; Close waits for it to finish sending reads before closing
+// the handle. Close may be called from within the writer passed to WriteTo.
+func (f *File) Close() (err error) {
+	defer f.c.logOp("close", f.path, &err)
+	atomic.StoreInt32(&f.closed, 1)
+	f.closeMu.Lock()
+	defer f.closeMu.Unlock()
+	f.c.written.remove(f)
 	return f.c.close(f.handle)
 }
 
+// FileStats holds the counters returned by File.Stats.
+type FileStats struct {
+	BytesRead     uint64 // data bytes received in replies to read requests
+	BytesWritten  uint64 // data bytes sent in write requests
+	ReadRequests  uint64 // read requests sent
+	WriteRequests uint64 // write requests sent
+	Retries       uint64 // read requests sent again, for the rest of a short read or after a failure
+}
+
+// Stats returns the counters of the requests made through f so far, which
+// may help to find out why a transfer is slow. It is safe to call while
+// other methods of f are running.
+func (f *File) Stats() FileStats {
+	return FileStats{
+		BytesRead:     atomic.LoadUint64(&f.stats.BytesRead),
+		BytesWritten:  atomic.LoadUint64(&f.stats.BytesWritten),
+		ReadRequests:  atomic.LoadUint64(&f.stats.ReadRequests),
+		WriteRequests: atomic.LoadUint64(&f.stats.WriteRequests),
+		Retries:       atomic.LoadUint64(&f.stats.Retries),
+	}
+}
+
+func (f *File) countWrite(n int) {
+	atomic.AddUint64(&f.stats.WriteRequests, 1)
+	atomic.AddUint64(&f.stats.BytesWritten, uint64(n))
+}
+
+// CancelPending makes the Read, ReadAt, Write, WriteTo and ReadFrom calls in
+// progress on f return context.Canceled, without waiting for the server to
+// answer their outstanding requests. Other files on the same Client are not
+// affected, and f can be used again afterwards. As the server may still carry
+// out the cancelled requests, the contents of the file, or of the buffers
+// being read into, are undefined after a cancelled write or read.
+func (f *File) CancelPending() {
+	f.c.cancelOwned(f, context.Canceled)
+}
+
 // Name returns the name of the file as presented to Open or Create.
 func (f *File) Name() string {
-	return f.path
+	return f.name
 }
 
 // Read reads up to len(b) bytes from the File. It returns the number of bytes
@@ -873,7 +2777,8 @@ func (f *File) Read(b []byte) (int, error) {
 // the number of bytes read and an error, if any. ReadAt follows io.ReaderAt semantics,
 // so the file offset is not altered during the read.
 func (f *File) ReadAt(b []byte, off int64) (n int, err error) {
-	// Split the read into multiple maxPacket sized concurrent reads
+	defer f.c.logOp("read", f.path, &err)
+	// Split the read into multiple readSize sized concurrent reads
 	// bounded by maxConcurrentRequests. This allows reads with a suitably
 	// large buffer to transfer data at a much faster rate due to
 	// overlapping round trip times.
@@ -896,12 +2801,13 @@ func (f *File) ReadAt(b []byte, off int64) (n int, err error) {
 
 	sendReq := func(b []byte, offset uint64) {
 		reqID := f.c.nextID()
-		f.c.dispatchRequest(ch, sshFxpReadPacket{
+		f.c.dispatchOwnedRequest(f, ch, sshFxpReadPacket{
 			ID:     reqID,
 			Handle: f.handle,
 			Offset: offset,
 			Len:    uint32(len(b)),
 		})
+		atomic.AddUint64(&f.stats.ReadRequests, 1)
 		inFlight++
 		reqs[reqID] = inflightRead{b: b, offset: offset}
 	}
@@ -909,7 +2815,7 @@ func (f *File) ReadAt(b []byte, off int64) (n int, err error) {
 	var read int
 	for len(b) > 0 || inFlight > 0 {
 		for inFlight < desiredInFlight && len(b) > 0 && firstErr.err == nil {
-			l := min(len(b), f.c.maxPacket)
+			l := min(len(b), f.c.readSize())
 			rb := b[:l]
 			sendReq(rb, offset)
 			offset += uint64(l)
@@ -944,7 +2850,10 @@ func (f *File) ReadAt(b []byte, off int64) (n int, err error) {
 			l, data := unmarshalUint32(data)
 			n := copy(req.b, data[:l])
 			read += n
+			atomic.AddUint64(&f.stats.BytesRead, uint64(n))
+			f.limit.wait(n)
 			if n < len(req.b) {
+				atomic.AddUint64(&f.stats.Retries, 1)
 				sendReq(req.b[l:], req.offset+uint64(l))
 			}
 			if desiredInFlight < f.c.maxConcurrentRequests {
@@ -954,11 +2863,18 @@ func (f *File) ReadAt(b []byte, off int64) (n int, err error) {
 			firstErr = offsetErr{offset: 0, err: unimplementedPacketErr(res.typ)}
 		}
 	}
-	// If the error is anything other than EOF, then there
-	// may be gaps in the data copied to the buffer so it's
-	// best to return 0 so the caller can't make any
-	// incorrect assumptions about the state of the buffer.
-	if firstErr.err != nil && firstErr.err != io.EOF {
+	switch firstErr.err {
+	case nil:
+	case io.EOF:
+		// Every request below the lowest offset that hit EOF has been
+		// filled, so that offset is exactly where the data ends. Anything a
+		// misbehaving server sent back for requests past it is not counted.
+		read = int(firstErr.offset - uint64(off))
+	default:
+		// If the error is anything other than EOF, then there
+		// may be gaps in the data copied to the buffer so it's
+		// best to return 0 so the caller can't make any
+		// incorrect assumptions about the state of the buffer.
 		read = 0
 	}
 	return read, firstErr.err
@@ -970,7 +2886,14 @@ func (f *File) ReadAt(b []byte, off int64) (n int, err error) {
 // This method is preferred over calling Read multiple times to
 // maximise throughput for transferring the entire file (especially
 // over high latency links).
-func (f *File) WriteTo(w io.Writer) (int64, error) {
+func (f *File) WriteTo(w io.Writer) (written int64, err error) {
+	defer f.c.logOp("read", f.path, &err)
+	f.closeMu.RLock()
+	defer f.closeMu.RUnlock()
+	if atomic.LoadInt32(&f.closed) != 0 {
+		return 0, os.ErrClosed
+	}
+
 	var fileSize uint64
 	if f.c.useFstat {
 		fileStat, err := f.c.fstat(f.handle)
@@ -996,6 +2919,7 @@ func (f *File) WriteTo(w io.Writer) (int64, error) {
 	type inflightRead struct {
 		b      []byte
 		offset uint64
+		tries  int // times the read has been sent again
 	}
 	reqs := map[uint32]inflightRead{}
 	pendingWrites := map[uint64][]byte{}
@@ -1005,25 +2929,37 @@ func (f *File) WriteTo(w io.Writer) (int64, error) {
 	}
 	var firstErr offsetErr
 
-	sendReq := func(b []byte, offset uint64) {
+	sendReq := func(b []byte, offset uint64, tries int) {
 		reqID := f.c.nextID()
-		f.c.dispatchRequest(ch, sshFxpReadPacket{
+		f.c.dispatchOwnedRequest(f, ch, sshFxpReadPacket{
 			ID:     reqID,
 			Handle: f.handle,
 			Offset: offset,
 			Len:    uint32(len(b)),
 		})
+		atomic.AddUint64(&f.stats.ReadRequests, 1)
 		inFlight++
-		reqs[reqID] = inflightRead{b: b, offset: offset}
+		reqs[reqID] = inflightRead{b: b, offset: offset, tries: tries}
+	}
+
+	// write hands b to w without holding closeMu, so that w may call Close
+	write := func(b []byte) (int, error) {
+		f.closeMu.RUnlock()
+		defer f.closeMu.RLock()
+		return w.Write(b)
 	}
 
 	var copied int64
 	for firstErr.err == nil || inFlight > 0 {
+		if firstErr.err == nil && atomic.LoadInt32(&f.closed) != 0 {
+			// Close is waiting for the reads in flight to drain
+			firstErr = offsetErr{offset: 0, err: os.ErrClosed}
+		}
 		if firstErr.err == nil {
 			for inFlight+len(pendingWrites) < desiredInFlight {
-				b := make([]byte, f.c.maxPacket)
-				sendReq(b, offset)
-				offset += uint64(f.c.maxPacket)
+				b := make([]byte, f.c.readSize())
+				sendReq(b, offset, 0)
+				offset += uint64(len(b))
 				if offset > fileSize {
 					desiredInFlight = 1
 				}
@@ -1051,13 +2987,21 @@ func (f *File) WriteTo(w io.Writer) (int64, error) {
 		delete(reqs, reqID)
 		switch res.typ {
 		case sshFxpStatus:
+			err := normaliseError(unmarshalStatus(reqID, res.data))
+			if firstErr.err == nil && req.tries < f.c.readRetries && isTransientStatus(err) {
+				atomic.AddUint64(&f.stats.Retries, 1)
+				sendReq(req.b, req.offset, req.tries+1)
+				break
+			}
 			if firstErr.err == nil || req.offset < firstErr.offset {
-				firstErr = offsetErr{offset: req.offset, err: normaliseError(unmarshalStatus(reqID, res.data))}
+				firstErr = offsetErr{offset: req.offset, err: err}
 			}
 		case sshFxpData:
 			l, data := unmarshalUint32(data)
+			atomic.AddUint64(&f.stats.BytesRead, uint64(l))
+			f.limit.wait(int(l))
 			if req.offset == writeOffset {
-				nbytes, err := w.Write(data)
+				nbytes, err := write(data)
 				copied += int64(nbytes)
 				if err != nil {
 					// We will never receive another DATA with offset==writeOffset, so
@@ -1083,7 +3027,8 @@ func (f *File) WriteTo(w io.Writer) (int64, error) {
 					}
 					// Give go a chance to free the memory.
 					delete(pendingWrites, writeOffset)
-					nbytes, err := w.Write(pendingData)
+					nbytes, err := write(pendingData)
+					copied += int64(nbytes)
 					// Do not move writeOffset on error so subsequent iterations won't trigger
 					// any writes.
 					if err != nil {
@@ -1113,9 +3058,48 @@ func (f *File) WriteTo(w io.Writer) (int64, error) {
 	return copied, nil
 }
 
+// isTransientStatus reports whether err is a status a server may return for a
+// request which could succeed if sent again.
+func isTransientStatus(err error) bool {
+	serr, ok := err.(*StatusError)
+	if !ok {
+		return false
+	}
+	switch serr.Code {
+	case sshFxFailure, sshFxConnectionLost:
+		return true
+	}
+	return false
+}
+
+// Sync requests a flush of the contents of the file to stable storage on
+// the server, using the fsync@openssh.com extension. It returns a
+// *StatusError with code SSH_FX_OP_UNSUPPORTED if the server does not
+// support it.
+func (f *File) Sync() error {
+	if _, ok := f.c.HasExtension("fsync@openssh.com"); !ok {
+		return &StatusError{Code: sshFxOPUnsupported, msg: "fsync@openssh.com not supported by the server"}
+	}
+	id := f.c.nextID()
+	typ, data, err := f.c.sendPacket(sshFxpFsyncPacket{
+		ID:     id,
+		Handle: f.handle,
+	})
+	if err != nil {
+		return err
+	}
+	switch typ {
+	case sshFxpStatus:
+		return normaliseError(unmarshalStatus(id, data))
+	default:
+		return unimplementedPacketErr(typ)
+	}
+}
+
 // Stat returns the FileInfo structure describing file. If there is an
 // error.
-func (f *File) Stat() (os.FileInfo, error) {
+func (f *File) Stat() (fi os.FileInfo, err error) {
+	defer f.c.logOp("fstat", f.path, &err)
 	fs, err := f.c.fstat(f.handle)
 	if err != nil {
 		return nil, err
@@ -1131,29 +3115,57 @@ func (f *File) Stat() (os.FileInfo, error) {
 // over high latency links) it is recommended to use ReadFrom rather
 // than calling Write multiple times. io.Copy will do this
 // automatically.
-func (f *File) Write(b []byte) (int, error) {
+func (f *File) Write(b []byte) (n int, err error) {
+	defer f.c.logOp("write", f.path, &err)
+	n, err = f.writeAt(b, f.offset)
+	f.offset += uint64(n)
+	return n, err
+}
+
+// WriteAt writes len(b) bytes to the File at offset off, following
+// io.WriterAt semantics: the file offset used by Read and Write is neither
+// used nor changed. As with Write, the data is split into concurrent writes,
+// and on an error nothing is counted as written, since there may be gaps in
+// what reached the file.
+func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
+	defer f.c.logOp("write", f.path, &err)
+	if off < 0 {
+		return 0, errors.Errorf("sftp: WriteAt at negative offset %d", off)
+	}
+	return f.writeAt(b, uint64(off))
+}
+
+// writeAt writes b to the file at off, like Write but leaving the file offset
+// alone. It returns len(b), or 0 and an error.
+func (f *File) writeAt(b []byte, off uint64) (int, error) {
+	defer f.c.writeCalls.end(f.c.writeCalls.start())
+	f.c.written.add(f)
 	// Split the write into multiple maxPacket sized concurrent writes
 	// bounded by maxConcurrentRequests. This allows writes with a suitably
 	// large buffer to transfer data at a much faster rate due to
 	// overlapping round trip times.
 	inFlight := 0
 	desiredInFlight := 1
-	offset := f.offset
+	offset := off
 	// see comment on same line in Read() above
 	ch := make(chan result, f.c.maxConcurrentRequests+1)
 	var firstErr error
 	written := len(b)
+	lengths := make(map[uint32]int) // of the outstanding writes
 	for len(b) > 0 || inFlight > 0 {
 		for inFlight < desiredInFlight && len(b) > 0 && firstErr == nil {
 			l := min(len(b), f.c.maxPacket)
 			rb := b[:l]
-			f.c.dispatchRequest(ch, sshFxpWritePacket{
-				ID:     f.c.nextID(),
+			id := f.c.nextID()
+			lengths[id] = l
+			f.c.dispatchOwnedRequest(f, ch, sshFxpWritePacket{
+				ID:     id,
 				Handle: f.handle,
 				Offset: offset,
 				Length: uint32(len(rb)),
 				Data:   rb,
 			})
+			f.countWrite(len(rb))
 			inFlight++
 			offset += uint64(l)
 			b = b[l:]
@@ -1171,11 +3183,14 @@ func (f *File) Write(b []byte) (int, error) {
 		switch res.typ {
 		case sshFxpStatus:
 			id, _ := unmarshalUint32(res.data)
+			l := lengths[id]
+			delete(lengths, id)
 			err := normaliseError(unmarshalStatus(id, res.data))
 			if err != nil && firstErr == nil {
 				firstErr = err
 				break
 			}
+			f.limit.wait(l)
 			if desiredInFlight < f.c.maxConcurrentRequests {
 				desiredInFlight++
 			}
@@ -1189,42 +3204,166 @@ func (f *File) Write(b []byte) (int, error) {
 	if firstErr != nil {
 		written = 0
 	}
-	f.offset += uint64(written)
+	if firstErr == nil && f.sync {
+		firstErr = f.Sync()
+	}
 	return written, firstErr
 }
 
+// AppendRecord writes b to the end of the file in a single write request, so
+// that b is never split up or interleaved with what other clients append at
+// the same time, as long as the server carries out each append atomically.
+// The file must have been opened with os.O_APPEND, and b may be no larger than
+// the maximum packet size, as splitting it would defeat the point. It returns
+// the size of the file after the write; with other writers around, that may
+// already count their later records too. The file offset is moved to that
+// size.
+func (f *File) AppendRecord(b []byte) (int64, error) {
+	if f.pflags&sshFxfAppend == 0 {
+		return 0, errors.Errorf("sftp: %s is not open for appending", f.path)
+	}
+	if len(b) > f.c.maxPacket {
+		return 0, errors.Errorf("sftp: record of %d bytes exceeds the maximum packet size of %d", len(b), f.c.maxPacket)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.c.written.add(f)
+
+	id := f.c.nextID()
+	typ, data, err := f.c.sendPacket(sshFxpWritePacket{
+		ID:     id,
+		Handle: f.handle,
+		Offset: f.offset, // ignored by the server in append mode
+		Length: uint32(len(b)),
+		Data:   b,
+	})
+	f.countWrite(len(b))
+	if err != nil {
+		return 0, err
+	}
+	switch typ {
+	case sshFxpStatus:
+		if err := normaliseError(unmarshalStatus(id, data)); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, unimplementedPacketErr(typ)
+	}
+	if f.sync {
+		if err := f.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	fs, err := f.c.fstat(f.handle)
+	if err != nil {
+		return 0, err
+	}
+	f.offset = fs.Size
+	return int64(fs.Size), nil
+}
+
+// A Range is a region of a file, of Length bytes from Offset.
+type Range struct {
+	Offset, Length int64
+}
+
+// WriteSparse writes the regions of the file given by ranges, in order, with
+// the data read from src: the first ranges[0].Length bytes of src go to
+// ranges[0].Offset, the next ones to ranges[1].Offset, and so on. The parts of
+// the file between the ranges are never written, so on a server which
+// supports sparse files they are left as holes, or as they were, and no zero
+// blocks are sent for them. The file is not extended past the last range;
+// truncate it to size first if it should be longer.
+//
+// The ranges must be sorted by offset and must not overlap. The file offset
+// is left alone. If src ends before the ranges are filled, WriteSparse
+// returns io.ErrUnexpectedEOF.
+func (f *File) WriteSparse(src io.Reader, ranges []Range) (err error) {
+	defer f.c.logOp("write", f.path, &err)
+	var end int64
+	for i, r := range ranges {
+		if r.Offset < 0 || r.Length < 0 {
+			return errors.Errorf("sftp: range %d is negative", i)
+		}
+		if r.Offset < end {
+			return errors.Errorf("sftp: range %d overlaps or precedes range %d", i, i-1)
+		}
+		end = r.Offset + r.Length
+	}
+
+	// large enough for a write to keep every allowed request in flight
+	buf := make([]byte, f.c.maxPacket*f.c.maxConcurrentRequests)
+	for _, r := range ranges {
+		for done := int64(0); done < r.Length; {
+			b := buf
+			if left := r.Length - done; left < int64(len(b)) {
+				b = b[:left]
+			}
+			if _, err := io.ReadFull(src, b); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return err
+			}
+			if _, err := f.writeAt(b, uint64(r.Offset+done)); err != nil {
+				return err
+			}
+			done += int64(len(b))
+		}
+	}
+	return nil
+}
+
 // ReadFrom reads data from r until EOF and writes it to the file. The return
 // value is the number of bytes read. Any error except io.EOF encountered
 // during the read is also returned.
 //
+// If a write fails, ReadFrom waits for all outstanding writes, returns the
+// error of the failed write with the lowest offset, and returns the length of
+// the contiguous run of writes the server confirmed from the starting offset,
+// which is where the file offset is left.
+//
 // This method is preferred over calling Write multiple times to
 // maximise throughput for transferring the entire file (especially
 // over high latency links).
-func (f *File) ReadFrom(r io.Reader) (int64, error) {
+func (f *File) ReadFrom(r io.Reader) (n int64, err error) {
+	defer f.c.logOp("write", f.path, &err)
+	defer f.c.writeCalls.end(f.c.writeCalls.start())
+	f.c.written.add(f)
 	inFlight := 0
 	desiredInFlight := 1
 	offset := f.offset
 	// see comment on same line in Read() above
 	ch := make(chan result, f.c.maxConcurrentRequests+1)
-	var firstErr error
-	read := int64(0)
+	// pending maps the id of each outstanding write to its offset and
+	// length, acked maps the offset of each confirmed write to its length
+	type span struct{ offset, length uint64 }
+	pending := make(map[uint32]span)
+	acked := make(map[uint64]uint64)
+	var readErr, connErr, writeErr error
+	writeErrOffset := uint64(0)
 	b := make([]byte, f.c.maxPacket)
-	for inFlight > 0 || firstErr == nil {
-		for inFlight < desiredInFlight && firstErr == nil {
+	failed := func() bool {
+		return readErr != nil || connErr != nil || writeErr != nil
+	}
+	for inFlight > 0 || !failed() {
+		for inFlight < desiredInFlight && !failed() {
 			n, err := r.Read(b)
 			if err != nil {
-				firstErr = err
+				readErr = err
 			}
-			f.c.dispatchRequest(ch, sshFxpWritePacket{
-				ID:     f.c.nextID(),
+			id := f.c.nextID()
+			pending[id] = span{offset, uint64(n)}
+			f.c.dispatchOwnedRequest(f, ch, sshFxpWritePacket{
+				ID:     id,
 				Handle: f.handle,
 				Offset: offset,
 				Length: uint32(n),
 				Data:   b[:n],
 			})
+			f.countWrite(n)
 			inFlight++
 			offset += uint64(n)
-			read += int64(n)
 		}
 
 		if inFlight == 0 {
@@ -1233,55 +3372,84 @@ func (f *File) ReadFrom(r io.Reader) (int64, error) {
 		res := <-ch
 		inFlight--
 		if res.err != nil {
-			firstErr = res.err
+			if connErr == nil {
+				connErr = res.err
+			}
 			continue
 		}
 		switch res.typ {
 		case sshFxpStatus:
 			id, _ := unmarshalUint32(res.data)
+			s := pending[id]
+			delete(pending, id)
 			err := normaliseError(unmarshalStatus(id, res.data))
-			if err != nil && firstErr == nil {
-				firstErr = err
+			if err != nil {
+				if writeErr == nil || s.offset < writeErrOffset {
+					writeErr, writeErrOffset = err, s.offset
+				}
 				break
 			}
+			if s.length > 0 {
+				acked[s.offset] = s.length
+			}
+			f.limit.wait(int(s.length))
 			if desiredInFlight < f.c.maxConcurrentRequests {
 				desiredInFlight++
 			}
 		default:
-			firstErr = unimplementedPacketErr(res.typ)
+			if connErr == nil {
+				connErr = unimplementedPacketErr(res.typ)
+			}
 		}
 	}
-	if firstErr == io.EOF {
-		firstErr = nil
+	// Writes may be confirmed out of order, so only the contiguous run of
+	// confirmed writes from the starting offset is known to be in the file.
+	read := uint64(0)
+	for {
+		length, ok := acked[f.offset+read]
+		if !ok {
+			break
+		}
+		read += length
 	}
-	// If error is non-nil, then there may be gaps in the data written to
-	// the file so it's best to return 0 so the caller can't make any
-	// incorrect assumptions about the state of the file.
-	if firstErr != nil {
-		read = 0
+	f.offset += read
+
+	switch {
+	case writeErr != nil:
+		return int64(read), writeErr
+	case connErr != nil:
+		return int64(read), connErr
+	case readErr != io.EOF:
+		return int64(read), readErr
+	case f.sync:
+		return int64(read), f.Sync()
 	}
-	f.offset += uint64(read)
-	return read, firstErr
+	return int64(read), nil
 }
 
 // Seek implements io.Seeker by setting the client offset for the next Read or
-// Write. It returns the next offset read. Seeking before or after the end of
-// the file is undefined. Seeking relative to the end calls Stat.
+// Write. It returns the next offset read. Seeking before the start of the
+// file fails with EINVAL and leaves the offset alone; seeking after the end
+// is allowed, as with os.File. Seeking relative to the end calls Stat.
 func (f *File) Seek(offset int64, whence int) (int64, error) {
+	var base int64
 	switch whence {
 	case io.SeekStart:
-		f.offset = uint64(offset)
 	case io.SeekCurrent:
-		f.offset = uint64(int64(f.offset) + offset)
+		base = int64(f.offset)
 	case io.SeekEnd:
 		fi, err := f.Stat()
 		if err != nil {
 			return int64(f.offset), err
 		}
-		f.offset = uint64(fi.Size() + offset)
+		base = fi.Size()
 	default:
 		return int64(f.offset), unimplementedSeekWhence(whence)
 	}
+	if base+offset < 0 {
+		return int64(f.offset), &os.PathError{Op: "seek", Path: f.path, Err: syscall.EINVAL}
+	}
+	f.offset = uint64(base + offset)
 	return int64(f.offset), nil
 }
 
@@ -1339,10 +3507,12 @@ func unmarshalStatus(id uint32, data []byte) error {
 	code, data := unmarshalUint32(data)
 	msg, data, _ := unmarshalStringSafe(data)
 	lang, _, _ := unmarshalStringSafe(data)
+	// the message and language tag are meant to be UTF-8, but come straight
+	// from the server, so do not let invalid bytes through into logs
 	return &StatusError{
 		Code: code,
-		msg:  msg,
-		lang: lang,
+		msg:  strings.ToValidUTF8(msg, "\uFFFD"),
+		lang: strings.ToValidUTF8(lang, "\uFFFD"),
 	}
 }
 
@@ -1353,8 +3523,28 @@ func marshalStatus(b []byte, err StatusError) []byte {
 	return b
 }
 
+// supportedFlags are the flags passed to OpenFile which flags converts.
+const supportedFlags = os.O_RDONLY | os.O_WRONLY | os.O_RDWR | os.O_APPEND | os.O_CREATE | os.O_TRUNC | os.O_EXCL
+
+// checkFlags returns an error naming the first flag in f which has no ssh
+// equivalent, if any. O_SYNC is carried out by the client, with an fsync
+// after each write, so it is only accepted if the server supports that.
+func (c *Client) checkFlags(f int) error {
+	if f&os.O_SYNC != 0 {
+		if _, ok := c.HasExtension("fsync@openssh.com"); !ok {
+			return errors.New("unsupported flag O_SYNC: server lacks fsync@openssh.com")
+		}
+		f &^= os.O_SYNC
+	}
+	unsupported := f &^ supportedFlags
+	if unsupported == 0 {
+		return nil
+	}
+	return errors.Errorf("unsupported flag %#x", unsupported&-unsupported)
+}
+
 // flags converts the flags passed to OpenFile into ssh flags.
-// Unsupported flags are ignored.
+// Unsupported flags are ignored; see checkFlags.
 func flags(f int) uint32 {
 	var out uint32
 	switch f & os.O_WRONLY {
@@ -5,6 +5,7 @@ package sftp
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding"
 	"errors"
@@ -278,6 +279,53 @@ func TestClientMkdirAll(t *testing.T) {
 	}
 }
 
+func TestClientRemoveEmptyDirs(t *testing.T) {
+	sftp, cmd := testClient(t, READWRITE, NODELAY)
+	defer cmd.Wait()
+	defer sftp.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, d := range []string{"a/b/c", "a/d", "e", "f/g"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "f/g/keep"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := sftp.RemoveEmptyDirs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(removed)
+	var want []string
+	for _, d := range []string{"a", "a/b", "a/b/c", "a/d", "e"} {
+		want = append(want, path.Join(dir, d))
+	}
+	if !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed %v, want %v", removed, want)
+	}
+	for _, d := range []string{"", "f", "f/g"} {
+		if _, err := os.Stat(filepath.Join(dir, d)); err != nil {
+			t.Errorf("%s was removed: %v", d, err)
+		}
+	}
+
+	// the root is removed once it is empty to begin with
+	if err := os.RemoveAll(filepath.Join(dir, "f")); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := sftp.RemoveEmptyDirs(dir); err != nil || !reflect.DeepEqual(removed, []string{dir}) {
+		t.Errorf("RemoveEmptyDirs of an empty root: %v, %v", removed, err)
+	}
+}
+
 func TestClientOpen(t *testing.T) {
 	sftp, cmd := testClient(t, READONLY, NODELAY)
 	defer cmd.Wait()
@@ -421,6 +469,43 @@ func TestClientCreate(t *testing.T) {
 	defer f2.Close()
 }
 
+func TestClientOpenFileTruncNoCreate(t *testing.T) {
+	sftp, cmd := testClient(t, READWRITE, NODELAY)
+	defer cmd.Wait()
+	defer sftp.Close()
+
+	d, err := ioutil.TempDir("", "sftptest-trunc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	missing := filepath.Join(d, "missing")
+	f, err := sftp.OpenFile(missing, os.O_WRONLY|os.O_TRUNC)
+	if err != os.ErrNotExist {
+		t.Errorf("OpenFile(O_WRONLY|O_TRUNC) of a missing file: got %v, want os.ErrNotExist", err)
+	}
+	if err == nil {
+		f.Close()
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("OpenFile without O_CREATE created the file: %v", err)
+	}
+
+	existing := filepath.Join(d, "existing")
+	if err := ioutil.WriteFile(existing, []byte("some content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err = sftp.OpenFile(existing, os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if fi, err := os.Stat(existing); err != nil || fi.Size() != 0 {
+		t.Errorf("OpenFile(O_WRONLY|O_TRUNC) of an existing file: got %v, %v, want it truncated", fi, err)
+	}
+}
+
 func TestClientAppend(t *testing.T) {
 	sftp, cmd := testClient(t, READWRITE, NODELAY)
 	defer cmd.Wait()
@@ -440,6 +525,42 @@ func TestClientAppend(t *testing.T) {
 	defer f2.Close()
 }
 
+func TestClientAppendWritesAtEnd(t *testing.T) {
+	sftp, cmd := testClient(t, READWRITE, NODELAY)
+	defer cmd.Wait()
+	defer sftp.Close()
+
+	f, err := ioutil.TempFile("", "sftptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("first line\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	f2, err := sftp.OpenFile(f.Name(), os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"second line\n", "third line\n"} {
+		if _, err := f2.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "first line\nsecond line\nthird line\n"; string(got) != want {
+		t.Errorf("after appending the file holds %q, want %q", got, want)
+	}
+}
+
 func TestClientCreateFailed(t *testing.T) {
 	sftp, cmd := testClient(t, READONLY, NODELAY)
 	defer cmd.Wait()
@@ -628,6 +749,41 @@ func TestClientRemoveFailed(t *testing.T) {
 	}
 }
 
+func TestClientRemoveDirectory(t *testing.T) {
+	sftp, cmd := testClient(t, READWRITE, NODELAY)
+	defer cmd.Wait()
+	defer sftp.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sftp.RemoveDirectory(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(dir); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestClientRemoveDirectoryFailed(t *testing.T) {
+	sftp, cmd := testClient(t, READONLY, NODELAY)
+	defer cmd.Wait()
+	defer sftp.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dir)
+	if err := sftp.RemoveDirectory(dir); !isStatusCode(err, sshFxPermissionDenied) {
+		t.Fatalf("RemoveDirectory(%v): want: permission denied, got %v", dir, err)
+	}
+	if _, err := os.Lstat(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestClientRename(t *testing.T) {
 	sftp, cmd := testClient(t, READWRITE, NODELAY)
 	defer cmd.Wait()
@@ -651,6 +807,49 @@ func TestClientRename(t *testing.T) {
 	}
 }
 
+func TestClientSwap(t *testing.T) {
+	sftp, cmd := testClient(t, READWRITE, NODELAY)
+	defer cmd.Wait()
+	defer sftp.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	if err := ioutil.WriteFile(a, []byte("contents of a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(b, []byte("contents of b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sftp.Swap(a, b); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(a); err != nil || string(got) != "contents of b" {
+		t.Errorf("a holds %q, %v; want the contents of b", got, err)
+	}
+	if got, err := ioutil.ReadFile(b); err != nil || string(got) != "contents of a" {
+		t.Errorf("b holds %q, %v; want the contents of a", got, err)
+	}
+	if fis, err := ioutil.ReadDir(dir); err != nil || len(fis) != 2 {
+		t.Errorf("the temporary file was left behind: %d entries, %v", len(fis), err)
+	}
+
+	// swapping with a missing file fails and leaves a in place
+	if err := sftp.Swap(a, filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("Swap with a missing file succeeded")
+	}
+	if got, err := ioutil.ReadFile(a); err != nil || string(got) != "contents of b" {
+		t.Errorf("after a failed Swap, a holds %q, %v", got, err)
+	}
+	if fis, err := ioutil.ReadDir(dir); err != nil || len(fis) != 2 {
+		t.Errorf("a failed Swap left %d entries, %v", len(fis), err)
+	}
+}
+
 func TestClientPosixRename(t *testing.T) {
 	sftp, cmd := testClient(t, READWRITE, NODELAY)
 	defer cmd.Wait()
@@ -761,6 +960,213 @@ func TestClientSymlink(t *testing.T) {
 	}
 }
 
+func TestClientReadDirSpaces(t *testing.T) {
+	sftp, cmd := testClient(t, READWRITE, NODELAY)
+	defer cmd.Wait()
+	defer sftp.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const name = "two words.txt"
+	f, err := sftp.Create(path.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	fis, err := sftp.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 1 || fis[0].Name() != name {
+		t.Fatalf("ReadDir: got %v, want a single %q", fis, name)
+	}
+	f, err = sftp.Open(path.Join(dir, fis[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil || string(b) != "hello" {
+		t.Errorf("reading %q: %q, %v", name, b, err)
+	}
+}
+
+func TestClientDiff(t *testing.T) {
+	sftp, cmd := testClient(t, READONLY, NODELAY)
+	defer cmd.Wait()
+	defer sftp.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	remote, local := filepath.Join(dir, "remote"), filepath.Join(dir, "local")
+
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	write := func(p, contents string, mtime time.Time) {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, root := range []string{remote, local} {
+		write(filepath.Join(root, "same"), "same", mtime)
+		write(filepath.Join(root, "sub", "same"), "same", mtime)
+	}
+	write(filepath.Join(remote, "size"), "remote", mtime)
+	write(filepath.Join(local, "size"), "local", mtime)
+	write(filepath.Join(remote, "mtime"), "mtime", mtime)
+	write(filepath.Join(local, "mtime"), "mtime", mtime.Add(time.Hour))
+	write(filepath.Join(remote, "sub", "remote"), "remote", mtime)
+	write(filepath.Join(remote, "dir", "nested"), "nested", mtime)
+	write(filepath.Join(local, "local"), "local", mtime)
+	write(filepath.Join(remote, "kind", "file"), "file", mtime)
+	write(filepath.Join(local, "kind"), "file", mtime)
+
+	diffs, err := sftp.Diff(remote, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type entry struct {
+		path string
+		kind DiffKind
+	}
+	var got []entry
+	for _, d := range diffs {
+		got = append(got, entry{d.Path, d.Kind})
+		if (d.Remote == nil) != (d.Kind == LocalOnly) || (d.Local == nil) != (d.Kind == RemoteOnly) {
+			t.Errorf("%s: FileInfos %v, %v do not fit %v", d.Path, d.Remote, d.Local, d.Kind)
+		}
+	}
+	want := []entry{
+		{"dir", RemoteOnly},
+		{"dir/nested", RemoteOnly},
+		{"kind", TypeMismatch},
+		{"kind/file", RemoteOnly},
+		{"local", LocalOnly},
+		{"mtime", MtimeMismatch},
+		{"size", SizeMismatch},
+		{"sub/remote", RemoteOnly},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff:\n got %v\nwant %v", got, want)
+	}
+}
+
+func TestClientStatTree(t *testing.T) {
+	sftp, cmd := testClient(t, READONLY, NODELAY)
+	defer cmd.Wait()
+	defer sftp.Close()
+
+	makeTree(t)
+	defer os.RemoveAll(tree.name)
+
+	got, err := sftp.StatTree(tree.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nodes int
+	walkTree(tree, tree.name, func(path string, n *Node) {
+		nodes++
+		fi, ok := got[path]
+		if !ok {
+			t.Errorf("%s: missing from StatTree", path)
+			return
+		}
+		if isDir := n.entries != nil; fi.IsDir() != isDir {
+			t.Errorf("%s: IsDir = %v, want %v", path, fi.IsDir(), isDir)
+		}
+		if fi.Name() != filepath.Base(path) {
+			t.Errorf("%s: Name = %q", path, fi.Name())
+		}
+	})
+	if len(got) != nodes {
+		t.Errorf("StatTree returned %d paths, want %d", len(got), nodes)
+	}
+}
+
+func TestClientDirSize(t *testing.T) {
+	sftp, cmd := testClient(t, READONLY, NODELAY)
+	defer cmd.Wait()
+	defer sftp.Close()
+
+	makeTree(t)
+	defer os.RemoveAll(tree.name)
+	walkTree(tree, tree.name, func(path string, n *Node) {
+		if n.entries == nil {
+			if err := ioutil.WriteFile(path, []byte(path), 0640); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	if err := os.Symlink("a", filepath.Join(tree.name, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	var want int64
+	err := filepath.Walk(tree.name, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			want += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := sftp.DirSize(tree.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("DirSize(%q) = %d, want %d", tree.name, got, want)
+	}
+}
+
+func TestClientResolveLink(t *testing.T) {
+	skipIfWindows(t) // No symlinks on windows.
+	sftp, cmd := testClient(t, READONLY, NODELAY)
+	defer cmd.Wait()
+	defer sftp.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "sub", "link")
+	if err := os.Symlink("../target", link); err != nil {
+		t.Fatal(err)
+	}
+
+	want := filepath.ToSlash(filepath.Join(dir, "target"))
+	if got, err := sftp.ResolveLink(link); err != nil {
+		t.Fatal(err)
+	} else if got != want {
+		t.Fatalf("ResolveLink(%q) = %q, want %q", link, got, want)
+	}
+}
+
 func TestClientChmod(t *testing.T) {
 	skipIfWindows(t) // No UNIX permissions.
 	sftp, cmd := testClient(t, READWRITE, NODELAY)
@@ -783,6 +1189,43 @@ func TestClientChmod(t *testing.T) {
 	}
 }
 
+func TestClientChmodAll(t *testing.T) {
+	skipIfWindows(t) // No UNIX permissions.
+	sftp, cmd := testClient(t, READWRITE, NODELAY)
+	defer cmd.Wait()
+	defer sftp.Close()
+
+	makeTree(t)
+	defer os.RemoveAll(tree.name)
+	link := filepath.Join(tree.name, "link")
+	if err := os.Symlink("a", link); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sftp.ChmodAll(tree.name, 0750, 0640); err != nil {
+		t.Fatal(err)
+	}
+	walkTree(tree, tree.name, func(path string, n *Node) {
+		want := os.FileMode(0640)
+		if n.entries != nil {
+			want = 0750
+		}
+		stat, err := os.Lstat(path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if stat.Mode()&os.ModePerm != want {
+			t.Errorf("%s: invalid perm %o, want %o", path, stat.Mode()&os.ModePerm, want)
+		}
+	})
+	if stat, err := os.Lstat(link); err != nil {
+		t.Fatal(err)
+	} else if stat.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("%s: symlink was replaced", link)
+	}
+}
+
 func TestClientChmodReadonly(t *testing.T) {
 	skipIfWindows(t) // No UNIX permissions.
 	sftp, cmd := testClient(t, READONLY, NODELAY)
@@ -917,6 +1360,124 @@ func TestClientChtimes(t *testing.T) {
 	}
 }
 
+func TestClientCopyAttrs(t *testing.T) {
+	sftp, cmd := testClient(t, READWRITE, NODELAY)
+	defer cmd.Wait()
+	defer sftp.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	for _, p := range []string{src, dst} {
+		if err := ioutil.WriteFile(p, []byte(p), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	atime := time.Date(2013, 2, 23, 13, 24, 35, 0, time.UTC)
+	mtime := time.Date(1985, 6, 12, 6, 6, 6, 0, time.UTC)
+	if err := os.Chmod(src, 0751); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(src, atime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sftp.CopyAttrs(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	sfi, err := sftp.Lstat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dfi, err := sftp.Lstat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dfi.Mode() != sfi.Mode() {
+		t.Errorf("dst has mode %v, want %v", dfi.Mode(), sfi.Mode())
+	}
+	sst, dstat := sfi.Sys().(*FileStat), dfi.Sys().(*FileStat)
+	if dstat.UID != sst.UID || dstat.GID != sst.GID {
+		t.Errorf("dst is owned by %d:%d, want %d:%d", dstat.UID, dstat.GID, sst.UID, sst.GID)
+	}
+	// not every server reports the atime it was given, so compare with src
+	if dstat.Atime != sst.Atime || dstat.Mtime != uint32(mtime.Unix()) {
+		t.Errorf("dst has atime %d and mtime %d, want %d and %d", dstat.Atime, dstat.Mtime, sst.Atime, mtime.Unix())
+	}
+}
+
+func TestClientTouch(t *testing.T) {
+	sftp, cmd := testClient(t, READWRITE, NODELAY)
+	defer cmd.Wait()
+	defer sftp.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a new path is created
+	name := filepath.Join(dir, "new")
+	if err := sftp.Touch(name); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := os.Stat(name); err != nil {
+		t.Fatal(err)
+	} else if !stat.Mode().IsRegular() || stat.Size() != 0 {
+		t.Fatalf("unexpected file: %v %d", stat.Mode(), stat.Size())
+	}
+
+	// an existing path keeps its contents and gets a newer mtime
+	if err := ioutil.WriteFile(name, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Date(1985, 6, 12, 6, 6, 6, 0, time.UTC)
+	if err := os.Chtimes(name, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := sftp.Touch(name); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := os.Stat(name); err != nil {
+		t.Fatal(err)
+	} else if !stat.ModTime().After(old) {
+		t.Fatalf("mtime not advanced: %v", stat.ModTime())
+	} else if stat.Size() != 5 {
+		t.Fatalf("contents changed: size %d", stat.Size())
+	}
+}
+
+func TestClientCheckLargeFileSupport(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping 5GB sparse file test in short mode")
+	}
+	sftp, cmd := testClient(t, READWRITE, NODELAY)
+	defer cmd.Wait()
+	defer sftp.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "big")
+	ok, err := sftp.CheckLargeFileSupport(name)
+	if err != nil {
+		t.Skipf("local filesystem cannot hold the test file: %v", err)
+	}
+	if !ok {
+		t.Error("CheckLargeFileSupport = false")
+	}
+	if _, err := os.Lstat(name); !os.IsNotExist(err) {
+		t.Errorf("test file was not removed: %v", err)
+	}
+}
+
 func TestClientChtimesReadonly(t *testing.T) {
 	sftp, cmd := testClient(t, READONLY, NODELAY)
 	defer cmd.Wait()
@@ -1292,8 +1853,8 @@ func TestClientReadFromDeadlock(t *testing.T) {
 		b := make([]byte, 32768*4)
 		content := bytes.NewReader(b)
 		n, err := f.ReadFrom(content)
-		if n != 0 {
-			t.Fatal("Write should return 0", n)
+		if n != 32768 {
+			t.Fatal("ReadFrom should return the one good packet", n)
 		}
 		if err != errFakeNet {
 			t.Fatal("Didn't recieve correct error", err)
@@ -1605,6 +2166,86 @@ func TestClientWalk(t *testing.T) {
 	}
 }
 
+func TestClientWalkChan(t *testing.T) {
+	sftp, cmd := testClient(t, READONLY, NODELAY)
+	defer cmd.Wait()
+	defer sftp.Close()
+
+	makeTree(t)
+	defer os.RemoveAll(tree.name)
+
+	entries, errc := sftp.WalkChan(context.Background(), tree.name)
+	var errors []error
+	for e := range entries {
+		mark(e.Path, e.Info, nil, &errors, false)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("WalkChan: %v", err)
+	}
+	checkMarks(t, true)
+
+	// cancelling stops the walk and closes both channels
+	ctx, cancel := context.WithCancel(context.Background())
+	entries, errc = sftp.WalkChan(ctx, tree.name)
+	<-entries
+	cancel()
+	for range entries {
+	}
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("WalkChan after cancel: got %v, want context.Canceled", err)
+	}
+	if _, ok := <-errc; ok {
+		t.Errorf("error channel left open after the walk stopped")
+	}
+}
+
+func TestClientReadDirTree(t *testing.T) {
+	sftp, cmd := testClient(t, READONLY, NODELAY)
+	defer cmd.Wait()
+	defer sftp.Close()
+
+	makeTree(t)
+	defer os.RemoveAll(tree.name)
+	if err := ioutil.WriteFile(filepath.Join(tree.name, "a"), []byte("not empty"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := sftp.ReadDir(tree.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]os.FileInfo{}
+	for _, fi := range infos {
+		if fi.Name() == "." || fi.Name() == ".." {
+			t.Errorf("ReadDir returned %q", fi.Name())
+		}
+		got[fi.Name()] = fi
+	}
+	if len(got) != len(tree.entries) {
+		t.Errorf("ReadDir returned %d entries, want %d", len(got), len(tree.entries))
+	}
+	for _, n := range tree.entries {
+		fi, ok := got[n.name]
+		if !ok {
+			t.Errorf("ReadDir is missing %s", n.name)
+			continue
+		}
+		want, err := os.Lstat(filepath.Join(tree.name, n.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.IsDir() != (n.entries != nil) || fi.Mode() != want.Mode() {
+			t.Errorf("%s: got mode %v, want %v", n.name, fi.Mode(), want.Mode())
+		}
+		if !fi.IsDir() && fi.Size() != want.Size() {
+			t.Errorf("%s: got size %d, want %d", n.name, fi.Size(), want.Size())
+		}
+		if fi.ModTime().Unix() != want.ModTime().Unix() {
+			t.Errorf("%s: got mtime %v, want %v", n.name, fi.ModTime(), want.ModTime())
+		}
+	}
+}
+
 type MatchTest struct {
 	pattern, s string
 	match      bool
@@ -1,11 +1,26 @@
 package sftp
 
 import (
+	"bytes"
+	"context"
+	"encoding"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"os"
+	"path"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/kr/fs"
 )
@@ -16,6 +31,12 @@ var _ fs.FileSystem = new(Client)
 // assert that *File implements io.ReadWriteCloser
 var _ io.ReadWriteCloser = new(File)
 
+// assert that *File implements io.ReadWriteSeeker
+var _ io.ReadWriteSeeker = new(File)
+
+// assert that *File implements io.WriterAt
+var _ io.WriterAt = new(File)
+
 func TestNormaliseError(t *testing.T) {
 	var (
 		ok         = &StatusError{Code: sshFxOk}
@@ -77,6 +98,7 @@ var flagsTests = []struct {
 	{os.O_RDWR, sshFxfRead | sshFxfWrite},
 	{os.O_RDWR | os.O_CREATE | os.O_TRUNC, sshFxfRead | sshFxfWrite | sshFxfCreat | sshFxfTrunc},
 	{os.O_WRONLY | os.O_APPEND, sshFxfWrite | sshFxfAppend},
+	{os.O_WRONLY | os.O_TRUNC, sshFxfWrite | sshFxfTrunc},
 }
 
 func TestFlags(t *testing.T) {
@@ -146,6 +168,34 @@ func TestUnmarshalStatus(t *testing.T) {
 	}
 }
 
+func TestUnmarshalStatusInvalidUTF8(t *testing.T) {
+	b := marshalUint32(nil, 1)
+	b = marshalUint32(b, sshFxFailure)
+	b = marshalString(b, "bad \xff\xfe msg")
+	b = marshalString(b, "en\xc3")
+
+	err := unmarshalStatus(1, b)
+	statusErr, ok := err.(*StatusError)
+	if !ok {
+		t.Fatalf("unmarshalStatus: want *StatusError, got %#v", err)
+	}
+	if !utf8.ValidString(statusErr.msg) || !utf8.ValidString(statusErr.lang) {
+		t.Errorf("unmarshalStatus kept invalid UTF-8: msg %q, lang %q", statusErr.msg, statusErr.lang)
+	}
+	msg := err.Error()
+	if !utf8.ValidString(msg) {
+		t.Fatalf("Error() is not valid UTF-8: %q", msg)
+	}
+	for _, r := range msg {
+		if !unicode.IsPrint(r) {
+			t.Fatalf("Error() contains unprintable rune %U: %q", r, msg)
+		}
+	}
+	if !strings.Contains(msg, "bad") || !strings.Contains(msg, "msg") {
+		t.Errorf("Error() lost the readable parts of the message: %q", msg)
+	}
+}
+
 type packetSizeTest struct {
 	size  int
 	valid bool
@@ -208,3 +258,3165 @@ func TestUseFstatChecked(t *testing.T) {
 	testFstatOption(t, UseFstat(true), true)
 	testFstatOption(t, UseFstat(false), false)
 }
+
+// newFakeClient returns a Client connected to a scripted server. After the
+// version exchange handle is called with the type and body of every packet
+// the client sends, and whatever it returns is sent back; returning nil
+// sends nothing.
+func newFakeClient(t *testing.T, handle func(typ byte, data []byte) encoding.BinaryMarshaler, opts ...ClientOption) *Client {
+	return newFakeClientExt(t, nil, handle, opts...)
+}
+
+// newFakeClientExt is like newFakeClient, but the server advertises exts in
+// its version packet.
+func newFakeClientExt(t *testing.T, exts []sshExtensionPair, handle func(typ byte, data []byte) encoding.BinaryMarshaler, opts ...ClientOption) *Client {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	go func() {
+		svr := &conn{Reader: sr, WriteCloser: sw}
+		defer svr.Close()
+		if _, _, err := svr.recvPacket(0); err != nil {
+			return
+		}
+		if err := svr.sendPacket(sshFxVersionPacket{Version: sftpProtocolVersion, Extensions: exts}); err != nil {
+			return
+		}
+		for {
+			typ, data, err := svr.recvPacket(0)
+			if err != nil {
+				return
+			}
+			reply := handle(typ, data)
+			replies, ok := reply.(fakeReplies)
+			if !ok {
+				replies = fakeReplies{reply}
+			}
+			for _, reply := range replies {
+				if reply == nil {
+					continue
+				}
+				if err := svr.sendPacket(reply); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	c, err := NewClientPipe(cr, cw, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// fakeReplies can be returned by the handle function of a fake client to
+// send several packets, in order, in reply to one request.
+type fakeReplies []encoding.BinaryMarshaler
+
+func (fakeReplies) MarshalBinary() ([]byte, error) {
+	panic("fakeReplies must not be sent as such")
+}
+
+func fakeStatus(id, code uint32) sshFxpStatusPacket {
+	return sshFxpStatusPacket{ID: id, StatusError: StatusError{Code: code}}
+}
+
+func TestReadDirStream(t *testing.T) {
+	const batches, perBatch = 1000, 100
+	var readdirs int
+	closed := make(chan struct{})
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, data := unmarshalUint32(data)
+		switch typ {
+		case sshFxpOpendir:
+			return sshFxpHandlePacket{ID: id, Handle: "dir"}
+		case sshFxpReaddir:
+			if readdirs == batches {
+				return fakeStatus(id, sshFxEOF)
+			}
+			// entries are generated on demand, there is no listing to
+			// hold on to
+			var names []sshFxpNameAttr
+			for i := 0; i < perBatch; i++ {
+				name := fmt.Sprintf("file%d", readdirs*perBatch+i)
+				fi := fileInfoFromStat(&FileStat{Mode: 0100644}, name)
+				names = append(names, sshFxpNameAttr{Name: name, LongName: name, Attrs: []interface{}{fi}})
+			}
+			readdirs++
+			return sshFxpNamePacket{ID: id, NameAttrs: names}
+		case sshFxpClose:
+			close(closed)
+			return fakeStatus(id, sshFxOk)
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	})
+	defer c.Close()
+
+	var n int
+	err := c.ReadDirStream("/huge", func(fi os.FileInfo) error {
+		if want := fmt.Sprintf("file%d", n); fi.Name() != want {
+			return fmt.Errorf("got entry %q, want %q", fi.Name(), want)
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != batches*perBatch {
+		t.Fatalf("got %d entries, want %d", n, batches*perBatch)
+	}
+	<-closed
+
+	// stopping early issues no further READDIR requests and still closes
+	// the handle
+	readdirs = 0
+	closed = make(chan struct{})
+	n = 0
+	err = c.ReadDirStream("/huge", func(fi os.FileInfo) error {
+		n++
+		if n == perBatch+perBatch/2 {
+			return ErrStopReadDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-closed
+	if n != perBatch+perBatch/2 || readdirs != 2 {
+		t.Fatalf("stopped after %d entries and %d READDIRs, want %d and 2", n, readdirs, perBatch+perBatch/2)
+	}
+
+	// any other error is passed back to the caller
+	closed = make(chan struct{})
+	errStop := errors.New("stop")
+	err = c.ReadDirStream("/huge", func(fi os.FileInfo) error { return errStop })
+	if err != errStop {
+		t.Fatalf("got error %v, want %v", err, errStop)
+	}
+	<-closed
+}
+
+// gatedWriter counts the bytes written through it, after waiting for gate to
+// be closed if it isn't nil.
+type gatedWriter struct {
+	io.WriteCloser
+	gate    chan struct{}
+	entered chan struct{}
+	written int64
+}
+
+func (w *gatedWriter) Write(b []byte) (int, error) {
+	if w.gate != nil {
+		close(w.entered)
+		<-w.gate
+		w.gate = nil
+	}
+	n, err := w.WriteCloser.Write(b)
+	atomic.AddInt64(&w.written, int64(n))
+	return n, err
+}
+
+func TestClientFlush(t *testing.T) {
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, _ := unmarshalUint32(data)
+		return fakeStatus(id, sshFxOk)
+	})
+	defer c.Close()
+	w := &gatedWriter{gate: make(chan struct{}), entered: make(chan struct{})}
+	c.conn.Lock()
+	w.WriteCloser = c.conn.WriteCloser
+	c.conn.WriteCloser = w
+	c.conn.Unlock()
+
+	// the write stalls in the transport, holding up the send
+	f := &File{c: c, handle: "handle"}
+	data := make([]byte, 1024)
+	done := make(chan error, 1)
+	go func() {
+		_, err := f.Write(data)
+		done <- err
+	}()
+	<-w.entered
+
+	flushed := make(chan error, 1)
+	go func() { flushed <- c.Flush() }()
+	select {
+	case <-flushed:
+		t.Fatal("Flush returned before the pending packet was written")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(w.gate)
+	if err := <-flushed; err != nil {
+		t.Fatal(err)
+	}
+	// length, type, id, handle, offset, data length, data
+	want := int64(4 + 1 + 4 + 4 + len(f.handle) + 8 + 4 + len(data))
+	if got := atomic.LoadInt64(&w.written); got != want {
+		t.Fatalf("after Flush %d bytes were written, want %d", got, want)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientOpenFileContextCancel(t *testing.T) {
+	release := make(chan struct{})
+	closed := make(chan string, 1)
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, data := unmarshalUint32(data)
+		switch typ {
+		case sshFxpOpen:
+			// stall until the client has given up
+			<-release
+			return sshFxpHandlePacket{ID: id, Handle: "late"}
+		case sshFxpClose:
+			handle, _ := unmarshalString(data)
+			closed <- handle
+			return fakeStatus(id, sshFxOk)
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	})
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	f, err := c.OpenFileContext(ctx, "/foo", os.O_RDONLY)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("OpenFileContext: want %v, got %v, %v", context.DeadlineExceeded, f, err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("OpenFileContext took %v to return after cancellation", d)
+	}
+
+	close(release)
+	select {
+	case handle := <-closed:
+		if handle != "late" {
+			t.Errorf("closed handle %q, want %q", handle, "late")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("late handle was never closed")
+	}
+}
+
+func TestClientSendRequestWithCancel(t *testing.T) {
+	release := make(chan struct{})
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, _ := unmarshalUint32(data)
+		if typ == sshFxpStat {
+			p, _ := unmarshalString(data[4:])
+			if p == "/slow" {
+				<-release
+			}
+			return sshFxpStatResponse{ID: id, info: &fileInfo{name: path.Base(p)}}
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	})
+	defer c.Close()
+
+	id := c.nextID()
+	done := make(chan struct{})
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := c.sendRequestWithCancel(sshFxpStatPacket{ID: id, Path: "/slow"}, done)
+		errc <- err
+	}()
+	close(done)
+	select {
+	case err := <-errc:
+		if err != errRequestCancelled {
+			t.Fatalf("sendRequestWithCancel: got %v, want errRequestCancelled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sendRequestWithCancel did not return once done was closed")
+	}
+	c.clientConn.Lock()
+	_, registered := c.inflight[id]
+	c.clientConn.Unlock()
+	if registered {
+		t.Errorf("request %d is still waiting for a reply", id)
+	}
+
+	// the late reply is dropped, rather than taken for a duplicate
+	close(release)
+	if _, err := c.Stat("/fast"); err != nil {
+		t.Fatalf("Stat after the late reply: %v", err)
+	}
+}
+
+func TestClientWriteLargeBuffer(t *testing.T) {
+	const maxConcurrent = 8
+	const size = 64 << 20
+	var c *Client
+	var maxInflight int
+	var fileSize uint64
+	c = newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, data := unmarshalUint32(data)
+		switch typ {
+		case sshFxpOpen:
+			return sshFxpHandlePacket{ID: id, Handle: "h"}
+		case sshFxpWrite:
+			c.clientConn.Lock()
+			if n := len(c.inflight); n > maxInflight {
+				maxInflight = n
+			}
+			c.clientConn.Unlock()
+			_, data = unmarshalString(data)
+			offset, data := unmarshalUint64(data)
+			length, _ := unmarshalUint32(data)
+			if end := offset + uint64(length); end > fileSize {
+				fileSize = end
+			}
+			return fakeStatus(id, sshFxOk)
+		case sshFxpClose:
+			return fakeStatus(id, sshFxOk)
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	}, MaxConcurrentRequestsPerFile(maxConcurrent))
+	defer c.Close()
+
+	f, err := c.OpenFile("/foo", os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := f.Write(make([]byte, size))
+	if err != nil || n != size {
+		t.Fatalf("Write: want %d, nil, got %d, %v", size, n, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fileSize != size {
+		t.Errorf("server saw a file of %d bytes, want %d", fileSize, size)
+	}
+	if maxInflight > maxConcurrent {
+		t.Errorf("%d write packets were in flight at once, want at most %d", maxInflight, maxConcurrent)
+	}
+}
+
+// sparseFileServer is a fake server holding a single sparse file "/big",
+// optionally truncating every offset to 32 bits like some old servers do.
+func sparseFileServer(truncate bool, removed *bool) func(typ byte, data []byte) encoding.BinaryMarshaler {
+	contents := map[uint64]byte{}
+	var size uint64
+	off := func(o uint64) uint64 {
+		if truncate {
+			return uint64(uint32(o))
+		}
+		return o
+	}
+	return func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, data := unmarshalUint32(data)
+		switch typ {
+		case sshFxpOpen:
+			return sshFxpHandlePacket{ID: id, Handle: "big"}
+		case sshFxpWrite:
+			_, data = unmarshalString(data)
+			o, data := unmarshalUint64(data)
+			length, data := unmarshalUint32(data)
+			o = off(o)
+			for i := uint64(0); i < uint64(length); i++ {
+				contents[o+i] = data[i]
+			}
+			if o+uint64(length) > size {
+				size = o + uint64(length)
+			}
+			return fakeStatus(id, sshFxOk)
+		case sshFxpRead:
+			_, data = unmarshalString(data)
+			o, data := unmarshalUint64(data)
+			length, _ := unmarshalUint32(data)
+			o = off(o)
+			if o >= size {
+				return fakeStatus(id, sshFxEOF)
+			}
+			var b []byte
+			for i := o; i < size && i < o+uint64(length); i++ {
+				b = append(b, contents[i])
+			}
+			return &sshFxpDataPacket{ID: id, Length: uint32(len(b)), Data: b}
+		case sshFxpFstat:
+			return sshFxpStatResponse{ID: id, info: &fileInfo{name: "big", size: int64(size)}}
+		case sshFxpClose:
+			return fakeStatus(id, sshFxOk)
+		case sshFxpRemove:
+			*removed = true
+			return fakeStatus(id, sshFxOk)
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	}
+}
+
+func TestClientCheckLargeFileSupportFake(t *testing.T) {
+	for _, truncate := range []bool{false, true} {
+		var removed bool
+		c := newFakeClient(t, sparseFileServer(truncate, &removed))
+		ok, err := c.CheckLargeFileSupport("/big")
+		c.Close()
+		if err != nil {
+			t.Fatalf("truncate=%v: %v", truncate, err)
+		}
+		if ok == truncate {
+			t.Errorf("truncate=%v: CheckLargeFileSupport = %v", truncate, ok)
+		}
+		if !removed {
+			t.Errorf("truncate=%v: test file was not removed", truncate)
+		}
+	}
+}
+
+func TestClientSymlinkArgOrder(t *testing.T) {
+	// OpenSSH, and the server in this package, take the target path first;
+	// the SFTP draft puts the link path first.
+	for _, tt := range []struct {
+		standard      bool
+		first, second string
+	}{
+		{false, "target", "link"},
+		{true, "link", "target"},
+	} {
+		var first, second string
+		c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+			id, data := unmarshalUint32(data)
+			if typ == sshFxpSymlink {
+				first, data = unmarshalString(data)
+				second, _ = unmarshalString(data)
+				return fakeStatus(id, sshFxOk)
+			}
+			return fakeStatus(id, sshFxOPUnsupported)
+		}, SymlinkArgOrder(tt.standard))
+		err := c.Symlink("target", "link")
+		c.Close()
+		if err != nil {
+			t.Fatalf("standard=%v: %v", tt.standard, err)
+		}
+		if first != tt.first || second != tt.second {
+			t.Errorf("standard=%v: sent %q, %q, want %q, %q", tt.standard, first, second, tt.first, tt.second)
+		}
+	}
+}
+
+func TestClientWalkSkipErrors(t *testing.T) {
+	dir := fileInfoFromStat(&FileStat{Mode: 040755}, "")
+	file := fileInfoFromStat(&FileStat{Mode: 0100644}, "")
+	tree := map[string][]string{
+		"/r":        {"a", "locked", "sub"},
+		"/r/locked": nil,
+		"/r/sub":    {"b"},
+	}
+	listed := map[string]bool{}
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, data := unmarshalUint32(data)
+		switch typ {
+		case sshFxpLstat:
+			return sshFxpStatResponse{ID: id, info: dir}
+		case sshFxpOpendir:
+			p, _ := unmarshalString(data)
+			if p == "/r/locked" {
+				return fakeStatus(id, sshFxPermissionDenied)
+			}
+			return sshFxpHandlePacket{ID: id, Handle: p}
+		case sshFxpReaddir:
+			p, _ := unmarshalString(data)
+			if listed[p] {
+				return fakeStatus(id, sshFxEOF)
+			}
+			listed[p] = true
+			var names []sshFxpNameAttr
+			for _, name := range tree[p] {
+				fi := file
+				if _, ok := tree[p+"/"+name]; ok {
+					fi = dir
+				}
+				names = append(names, sshFxpNameAttr{Name: name, LongName: name, Attrs: []interface{}{fi}})
+			}
+			return sshFxpNamePacket{ID: id, NameAttrs: names}
+		case sshFxpClose:
+			return fakeStatus(id, sshFxOk)
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	})
+	defer c.Close()
+
+	var visited []string
+	errs := c.WalkSkipErrors("/r", func(path string, fi os.FileInfo) {
+		visited = append(visited, path)
+	})
+	want := []string{"/r", "/r/a", "/r/locked", "/r/sub", "/r/sub/b"}
+	if !reflect.DeepEqual(visited, want) {
+		t.Errorf("visited %v, want %v", visited, want)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("got errors %v, want one for /r/locked", errs)
+	}
+	if perr, ok := errs[0].(*os.PathError); !ok || perr.Path != "/r/locked" || !isStatusCode(perr.Err, sshFxPermissionDenied) {
+		t.Errorf("got error %#v, want a permission error for /r/locked", errs[0])
+	}
+}
+
+func isStatusCode(err error, code uint32) bool {
+	serr, ok := err.(*StatusError)
+	return ok && serr.Code == code
+}
+
+func TestFileAppendRecord(t *testing.T) {
+	var content []byte
+	var handles []uint32
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, data := unmarshalUint32(data)
+		switch typ {
+		case sshFxpOpen:
+			_, data = unmarshalString(data)
+			pflags, _ := unmarshalUint32(data)
+			handles = append(handles, pflags)
+			return sshFxpHandlePacket{ID: id, Handle: fmt.Sprint(len(handles) - 1)}
+		case sshFxpWrite:
+			handle, data := unmarshalString(data)
+			_, data = unmarshalUint64(data)
+			_, data = unmarshalUint32(data)
+			var h int
+			fmt.Sscan(handle, &h)
+			if handles[h]&sshFxfAppend == 0 {
+				return fakeStatus(id, sshFxFailure)
+			}
+			content = append(content, data...)
+			return fakeStatus(id, sshFxOk)
+		case sshFxpFstat:
+			return sshFxpStatResponse{ID: id, info: &fileInfo{name: "log", size: int64(len(content))}}
+		case sshFxpClose:
+			return fakeStatus(id, sshFxOk)
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	}, MaxPacket(1024))
+	defer c.Close()
+
+	const writers, records = 4, 25
+	record := func(w, i int) string {
+		return fmt.Sprintf("writer %d record %02d %s\n", w, i, strings.Repeat("x", 100))
+	}
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		go func(w int) {
+			f, err := c.OpenFile("/log", os.O_WRONLY|os.O_APPEND)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer f.Close()
+			for i := 0; i < records; i++ {
+				if _, err := f.AppendRecord([]byte(record(w, i))); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(w)
+	}
+	for w := 0; w < writers; w++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+		seen[line] = true
+	}
+	for w := 0; w < writers; w++ {
+		for i := 0; i < records; i++ {
+			if !seen[record(w, i)] {
+				t.Errorf("record %d of writer %d is missing or was split", i, w)
+			}
+		}
+	}
+	if want := writers * records * len(record(0, 0)); len(content) != want {
+		t.Errorf("file has %d bytes, want %d", len(content), want)
+	}
+
+	f, err := c.OpenFile("/log", os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.AppendRecord(make([]byte, 1025)); err == nil {
+		t.Error("AppendRecord of a record larger than a packet succeeded")
+	}
+	f, err = c.OpenFile("/log", os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.AppendRecord([]byte("x")); err == nil {
+		t.Error("AppendRecord on a file not opened with O_APPEND succeeded")
+	}
+}
+
+// newGarbageClient returns a client whose server completes the version
+// exchange and then, once the first request arrives, writes garbage.
+func newGarbageClient(t *testing.T, garbage []byte) *Client {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	go func() {
+		svr := &conn{Reader: sr, WriteCloser: sw}
+		if _, _, err := svr.recvPacket(0); err != nil {
+			return
+		}
+		if err := svr.sendPacket(sshFxVersionPacket{Version: sftpProtocolVersion}); err != nil {
+			return
+		}
+		if _, _, err := svr.recvPacket(0); err != nil {
+			return
+		}
+		sw.Write(garbage)
+		// keep reading so that the client is never blocked writing
+		io.Copy(ioutil.Discard, sr)
+	}()
+	c, err := NewClientPipe(cr, cw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClientIdleTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	var content []byte
+	c := newFakeClient(t, memFileServer(&content), IdleTimeout(timeout))
+	defer c.Close()
+
+	// activity more often than the timeout keeps the client open
+	for start := time.Now(); time.Since(start) < 3*timeout; {
+		if _, err := c.Stat("/foo"); err != nil {
+			t.Fatalf("Stat while active: %v", err)
+		}
+		time.Sleep(timeout / 10)
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- c.Wait() }()
+	select {
+	case err := <-closed:
+		if err != ErrClientClosed {
+			t.Errorf("Wait: got %v, want ErrClientClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client was not closed after being idle")
+	}
+	if _, err := c.Stat("/foo"); err != ErrClientClosed {
+		t.Errorf("Stat after the idle timeout: got %v, want ErrClientClosed", err)
+	}
+}
+
+// partialWriter accepts the first n bytes written to it, then fails.
+type partialWriter struct {
+	n      int
+	err    error
+	closed bool
+}
+
+func (w *partialWriter) Write(b []byte) (int, error) {
+	if len(b) > w.n {
+		n := w.n
+		w.n = 0
+		return n, w.err
+	}
+	w.n -= len(b)
+	return len(b), nil
+}
+
+func (w *partialWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestNewClientPipeHandshakeFailure(t *testing.T) {
+	errReset := errors.New("connection reset by peer")
+	w := &partialWriter{n: 3, err: errReset}
+	// the reader holds a valid VERSION, which must not be read after the
+	// INIT failed to go out
+	version, _ := sshFxVersionPacket{Version: sftpProtocolVersion}.MarshalBinary()
+	r := bytes.NewReader(append(marshalUint32(nil, uint32(len(version))), version...))
+
+	c, err := NewClientPipe(r, w)
+	if c != nil {
+		t.Fatal("NewClientPipe returned a client after the handshake failed")
+	}
+	if _, ok := err.(*TransportError); !ok || !errors.Is(err, errReset) {
+		t.Errorf("NewClientPipe: got %v, want a *TransportError wrapping %v", err, errReset)
+	}
+	if !w.closed {
+		t.Error("the transport was not closed after the handshake failed")
+	}
+	if r.Len() == 0 {
+		t.Error("the VERSION was read although the INIT was not sent")
+	}
+}
+
+func TestClientTransportError(t *testing.T) {
+	errReset := errors.New("connection reset by peer")
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	go func() {
+		svr := &conn{Reader: sr, WriteCloser: sw}
+		if _, _, err := svr.recvPacket(0); err != nil {
+			return
+		}
+		if err := svr.sendPacket(sshFxVersionPacket{Version: sftpProtocolVersion}); err != nil {
+			return
+		}
+		// the connection drops while the first request is outstanding
+		if _, _, err := svr.recvPacket(0); err != nil {
+			return
+		}
+		sw.CloseWithError(errReset)
+		sr.CloseWithError(errReset)
+	}()
+	c, err := NewClientPipe(cr, cw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = c.Stat("/foo")
+	terr, ok := err.(*TransportError)
+	if !ok {
+		t.Fatalf("Stat: got %T %v, want a *TransportError", err, err)
+	}
+	if terr.Op != "receive" || terr.Err != errReset || !errors.Is(err, errReset) {
+		t.Errorf("Stat: got %#v, want a receive error wrapping %v", terr, errReset)
+	}
+	if _, err := c.Lstat("/foo"); !errors.Is(err, errReset) {
+		t.Errorf("Lstat after the connection dropped: got %v, want it to wrap %v", err, errReset)
+	}
+}
+
+func TestClientClosedAfterVersion(t *testing.T) {
+	// the server sends its VERSION, and then the stream ends
+	version, _ := sshFxVersionPacket{Version: sftpProtocolVersion}.MarshalBinary()
+	r := bytes.NewReader(append(marshalUint32(nil, uint32(len(version))), version...))
+	c, err := NewClientPipe(r, &partialWriter{n: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Open("/foo")
+		done <- err
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Open hung after the server closed the session")
+	}
+	terr, ok := err.(*TransportError)
+	if !ok || terr.Op != "receive" || !terr.Early || terr.Err != io.EOF {
+		t.Fatalf("Open: got %#v, want an early receive *TransportError wrapping io.EOF", err)
+	}
+	if !strings.Contains(err.Error(), "before answering any request") {
+		t.Errorf("Open: error %q does not say the server closed early", err)
+	}
+	if _, err := c.Stat("/foo"); !errors.Is(err, io.EOF) {
+		t.Errorf("Stat after the early close: got %v, want it to wrap io.EOF", err)
+	}
+}
+
+func TestClientDuplicateResponse(t *testing.T) {
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, _ := unmarshalUint32(data)
+		if typ == sshFxpStat {
+			info := sshFxpStatResponse{ID: id, info: &fileInfo{name: "foo"}}
+			return fakeReplies{info, info}
+		}
+		return fakeStatus(id, sshFxOk)
+	})
+	defer c.Close()
+
+	if _, err := c.Stat("/foo"); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- c.Wait() }()
+	select {
+	case err := <-done:
+		if err != ErrDuplicateResponse {
+			t.Errorf("Wait: got %v, want ErrDuplicateResponse", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the second reply to a request went unnoticed")
+	}
+	if _, err := c.Lstat("/foo"); err != ErrDuplicateResponse {
+		t.Errorf("Lstat after the duplicate: got %v, want ErrDuplicateResponse", err)
+	}
+}
+
+func TestClientClosed(t *testing.T) {
+	var content []byte
+	c := newFakeClient(t, memFileServer(&content))
+	f, err := c.OpenFile("/foo", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := c.Open("/foo"); err != ErrClientClosed {
+			t.Errorf("Open after Close: got %v, want ErrClientClosed", err)
+		}
+		if _, err := c.Stat("/foo"); err != ErrClientClosed {
+			t.Errorf("Stat after Close: got %v, want ErrClientClosed", err)
+		}
+		if _, err := f.Write([]byte("data")); err != ErrClientClosed {
+			t.Errorf("Write after Close: got %v, want ErrClientClosed", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("operations after Close blocked")
+	}
+}
+
+func TestClientDesynchronizedStream(t *testing.T) {
+	// packets too short to hold a request id, including empty ones
+	var short []byte
+	for i := 0; i < 10; i++ {
+		short = append(short, 0, 0, 0, 2, sshFxpStatus, 0)
+		short = append(short, 0, 0, 0, 0)
+	}
+	c := newGarbageClient(t, short)
+	defer c.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Stat("/foo")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != ErrStreamDesynchronized {
+			t.Errorf("pending Stat: want %v, got %v", ErrStreamDesynchronized, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending Stat never returned")
+	}
+	if err := c.Wait(); err != ErrStreamDesynchronized {
+		t.Errorf("Wait: want %v, got %v", ErrStreamDesynchronized, err)
+	}
+	if _, err := c.Stat("/foo"); err != ErrStreamDesynchronized {
+		t.Errorf("Stat after shutdown: want %v, got %v", ErrStreamDesynchronized, err)
+	}
+
+	// arbitrary garbage shuts the client down too, with whatever error the
+	// framing happens to produce
+	garbage := make([]byte, 64<<10)
+	for i := range garbage {
+		garbage[i] = byte(i*7 + i>>8)
+	}
+	c = newGarbageClient(t, garbage)
+	defer c.Close()
+	go func() {
+		_, err := c.Stat("/foo")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Stat over a garbage stream succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stat over a garbage stream never returned")
+	}
+}
+
+func TestClientSameFile(t *testing.T) {
+	c := &Client{}
+	stat := func(name string, mtime uint32, ext ...StatExtended) os.FileInfo {
+		return fileInfoFromStat(&FileStat{Size: 42, Mode: 0100644, Mtime: mtime, UID: 1000, GID: 1000, Extended: ext}, name)
+	}
+	local, err := os.Stat(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		desc     string
+		fi1, fi2 os.FileInfo
+		want     bool
+	}{
+		{"same file", stat("a", 1), stat("a", 1), true},
+		{"same file with id", stat("a", 1, StatExtended{"id", "1"}), stat("a", 1, StatExtended{"id", "1"}), true},
+		{"different name", stat("a", 1), stat("b", 1), false},
+		{"different mtime", stat("a", 1), stat("a", 2), false},
+		{"different id", stat("a", 1, StatExtended{"id", "1"}), stat("a", 1, StatExtended{"id", "2"}), false},
+		{"id on one side only", stat("a", 1, StatExtended{"id", "1"}), stat("a", 1), false},
+		{"local file", local, local, false},
+	} {
+		if got := c.SameFile(tt.fi1, tt.fi2); got != tt.want {
+			t.Errorf("%s: SameFile = %v, want %v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestClientOpenAndStat(t *testing.T) {
+	// the server holds back its reply to the OPEN until the STAT has
+	// arrived too, so OpenAndStat only returns if it sent them together
+	var openID uint32
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, _ := unmarshalUint32(data)
+		switch typ {
+		case sshFxpOpen:
+			openID = id
+			return nil
+		case sshFxpStat:
+			return fakeReplies{
+				sshFxpHandlePacket{ID: openID, Handle: "h"},
+				sshFxpStatResponse{ID: id, info: &fileInfo{name: "foo", size: 42}},
+			}
+		case sshFxpClose:
+			return fakeStatus(id, sshFxOk)
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	})
+	defer c.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f, fi, err := c.OpenAndStat("/dir/foo")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer f.Close()
+		if fi.Name() != "foo" || fi.Size() != 42 {
+			t.Errorf("OpenAndStat: got %s of %d bytes, want foo of 42", fi.Name(), fi.Size())
+		}
+		if f.Name() != "/dir/foo" {
+			t.Errorf("OpenAndStat: file name %q, want /dir/foo", f.Name())
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OpenAndStat waited for the OPEN reply before sending the STAT")
+	}
+}
+
+func TestFileSyncOnWrite(t *testing.T) {
+	var content []byte
+	serve := memFileServer(&content)
+	var requests []string
+	c := newFakeClientExt(t, []sshExtensionPair{{"fsync@openssh.com", "1"}}, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		if typ == sshFxpExtended {
+			id, rest := unmarshalUint32(data)
+			ext, rest := unmarshalString(rest)
+			handle, _ := unmarshalString(rest)
+			requests = append(requests, ext+" "+handle)
+			return fakeStatus(id, sshFxOk)
+		}
+		if typ == sshFxpWrite {
+			requests = append(requests, "write")
+		}
+		return serve(typ, data)
+	})
+	defer c.Close()
+
+	f, err := c.OpenFile("/foo", os.O_WRONLY|os.O_SYNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := f.Write([]byte("record\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"write", "fsync@openssh.com h", "write", "fsync@openssh.com h"}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("requests: got %q, want %q", requests, want)
+	}
+
+	requests = nil
+	g, err := c.OpenFile("/foo", os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if _, err := g.Write([]byte("record\n")); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"write"}; !reflect.DeepEqual(requests, want) {
+		t.Errorf("requests without O_SYNC: got %q, want %q", requests, want)
+	}
+}
+
+func TestClientOpenFileUnsupportedFlag(t *testing.T) {
+	var opens int
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, _ := unmarshalUint32(data)
+		if typ == sshFxpOpen {
+			opens++
+			return sshFxpHandlePacket{ID: id, Handle: "h"}
+		}
+		return fakeStatus(id, sshFxOk)
+	})
+	defer c.Close()
+
+	for _, tt := range []struct {
+		flag int
+		want string
+	}{
+		{os.O_RDONLY | 1<<30, "0x40000000"},
+		{os.O_WRONLY | os.O_SYNC, "O_SYNC"},
+	} {
+		_, err := c.OpenFile("/foo", tt.flag)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("OpenFile(%#x): want an error naming %s, got %v", tt.flag, tt.want, err)
+		}
+	}
+	if opens != 0 {
+		t.Errorf("%d OPEN requests were sent for unsupported flags", opens)
+	}
+
+	f, err := c.OpenFile("/foo", os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_EXCL|os.O_APPEND)
+	if err != nil {
+		t.Fatalf("OpenFile with supported flags: %v", err)
+	}
+	f.Close()
+}
+
+// blockingWriter discards what is written to it, but its first Write closes
+// entered and then waits for gate to be closed.
+type blockingWriter struct {
+	entered, gate chan struct{}
+	once          sync.Once
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	w.once.Do(func() {
+		close(w.entered)
+		<-w.gate
+	})
+	return len(b), nil
+}
+
+func TestFileCloseDuringWriteTo(t *testing.T) {
+	const size = 64 << 20
+	var closed, readsAfterClose int
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, data := unmarshalUint32(data)
+		switch typ {
+		case sshFxpOpen:
+			return sshFxpHandlePacket{ID: id, Handle: "h"}
+		case sshFxpStat:
+			return sshFxpStatResponse{ID: id, info: &fileInfo{name: "foo", size: size}}
+		case sshFxpRead:
+			if closed > 0 {
+				readsAfterClose++
+				return fakeStatus(id, sshFxFailure)
+			}
+			_, data = unmarshalString(data)
+			offset, data := unmarshalUint64(data)
+			length, _ := unmarshalUint32(data)
+			if offset >= size {
+				return fakeStatus(id, sshFxEOF)
+			}
+			return &sshFxpDataPacket{ID: id, Length: length, Data: make([]byte, length)}
+		case sshFxpClose:
+			closed++
+			return fakeStatus(id, sshFxOk)
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	})
+	defer c.Close()
+
+	f, err := c.Open("/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &blockingWriter{entered: make(chan struct{}), gate: make(chan struct{})}
+	type writeToResult struct {
+		n   int64
+		err error
+	}
+	writeTo := make(chan writeToResult, 1)
+	go func() {
+		n, err := f.WriteTo(w)
+		writeTo <- writeToResult{n, err}
+	}()
+	<-w.entered
+
+	closeErr := make(chan error, 1)
+	go func() { closeErr <- f.Close() }()
+	for atomic.LoadInt32(&f.closed) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(w.gate)
+
+	select {
+	case res := <-writeTo:
+		if res.err != os.ErrClosed {
+			t.Errorf("WriteTo: want %v, got %v", os.ErrClosed, res.err)
+		}
+		if res.n >= size {
+			t.Errorf("WriteTo copied the whole file before noticing Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WriteTo did not return after Close")
+	}
+	if err := <-closeErr; err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if readsAfterClose != 0 {
+		t.Errorf("%d reads were sent after the handle was closed", readsAfterClose)
+	}
+
+	if _, err := f.WriteTo(ioutil.Discard); err != os.ErrClosed {
+		t.Errorf("WriteTo after Close: want %v, got %v", os.ErrClosed, err)
+	}
+}
+
+// closingWriter closes f the first time it is written to.
+type closingWriter struct {
+	f        *File
+	closeErr chan error
+	once     sync.Once
+}
+
+func (w *closingWriter) Write(b []byte) (int, error) {
+	w.once.Do(func() { w.closeErr <- w.f.Close() })
+	return len(b), nil
+}
+
+func TestFileCloseFromWriteTo(t *testing.T) {
+	const size = 64 << 20
+	var content []byte
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, data := unmarshalUint32(data)
+		switch typ {
+		case sshFxpOpen:
+			return sshFxpHandlePacket{ID: id, Handle: "h"}
+		case sshFxpStat:
+			return sshFxpStatResponse{ID: id, info: &fileInfo{name: "foo", size: size}}
+		case sshFxpRead:
+			_, data = unmarshalString(data)
+			offset, data := unmarshalUint64(data)
+			length, _ := unmarshalUint32(data)
+			if offset >= size {
+				return fakeStatus(id, sshFxEOF)
+			}
+			if content == nil {
+				content = make([]byte, length)
+			}
+			return &sshFxpDataPacket{ID: id, Length: length, Data: content[:length]}
+		case sshFxpClose:
+			return fakeStatus(id, sshFxOk)
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	})
+	defer c.Close()
+
+	f, err := c.Open("/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &closingWriter{f: f, closeErr: make(chan error, 1)}
+	writeTo := make(chan error, 1)
+	go func() {
+		_, err := f.WriteTo(w)
+		writeTo <- err
+	}()
+
+	select {
+	case err := <-writeTo:
+		if err != os.ErrClosed {
+			t.Errorf("WriteTo: want %v, got %v", os.ErrClosed, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WriteTo deadlocked when its writer closed the file")
+	}
+	if err := <-w.closeErr; err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
+
+func TestClientStatVFSCache(t *testing.T) {
+	var requests int
+	newClient := func(ttl time.Duration) *Client {
+		return newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+			id, data := unmarshalUint32(data)
+			if name, _ := unmarshalString(data); typ != sshFxpExtended || name != "statvfs@openssh.com" {
+				return fakeStatus(id, sshFxOPUnsupported)
+			}
+			requests++
+			return &StatVFS{ID: id, Bsize: 4096, Bfree: uint64(requests), Fsid: 7}
+		}, WithStatVFSCache(ttl))
+	}
+
+	c := newClient(time.Hour)
+	defer c.Close()
+	for i, tt := range []struct {
+		path     string
+		requests int
+	}{
+		{"/a", 1},
+		{"/a", 1}, // cached
+		{"/b", 2}, // a path not asked for before
+		{"/a", 2}, // refreshed by the reply for /b
+	} {
+		vfs, err := c.StatVFS(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if requests != tt.requests {
+			t.Errorf("#%d: StatVFS(%q) made %d requests in all, want %d", i, tt.path, requests, tt.requests)
+		}
+		if vfs.Bfree != uint64(tt.requests) {
+			t.Errorf("#%d: StatVFS(%q) returned Bfree %d, want %d", i, tt.path, vfs.Bfree, tt.requests)
+		}
+		vfs.Bfree = 1 << 40 // must not change the cached copy
+	}
+
+	requests = 0
+	c = newClient(time.Nanosecond)
+	defer c.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := c.StatVFS("/a"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if requests != 2 {
+		t.Errorf("expired results were used: %d requests, want 2", requests)
+	}
+}
+
+func TestClientNegativeStatCache(t *testing.T) {
+	exists := map[string]bool{}
+	dangling := map[string]bool{"/link": true}
+	var stats int
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, data := unmarshalUint32(data)
+		p, _ := unmarshalString(data)
+		switch typ {
+		case sshFxpStat, sshFxpLstat:
+			stats++
+			if !exists[p] && !(typ == sshFxpLstat && dangling[p]) {
+				return fakeStatus(id, sshFxNoSuchFile)
+			}
+			return sshFxpStatResponse{ID: id, info: &fileInfo{name: path.Base(p)}}
+		case sshFxpOpen:
+			exists[p] = true
+			return sshFxpHandlePacket{ID: id, Handle: p}
+		case sshFxpRename:
+			// the directory renamed holds a file a
+			newname, _ := unmarshalString(data[4+len(p):])
+			exists[newname] = true
+			exists[newname+"/a"] = true
+			return fakeStatus(id, sshFxOk)
+		case sshFxpClose:
+			return fakeStatus(id, sshFxOk)
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	}, WithNegativeStatCache(time.Hour))
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.Lstat("/foo.sha256"); err != os.ErrNotExist {
+			t.Fatalf("Lstat of a missing file: got %v, want os.ErrNotExist", err)
+		}
+	}
+	if _, err := c.Stat("/foo.sha256"); err != os.ErrNotExist {
+		t.Fatalf("Stat of a missing file: got %v, want os.ErrNotExist", err)
+	}
+	if stats != 1 {
+		t.Errorf("%d requests for a path known to be missing, want 1", stats)
+	}
+
+	f, err := c.Create("/foo.sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := c.Lstat("/foo.sha256"); err != nil {
+		t.Errorf("Lstat after Create: %v", err)
+	}
+	if stats != 2 {
+		t.Errorf("Create did not forget the missing path: %d requests, want 2", stats)
+	}
+
+	// a dangling symlink is missing to Stat, but not to Lstat
+	if _, err := c.Stat("/link"); err != os.ErrNotExist {
+		t.Fatalf("Stat of a dangling symlink: got %v, want os.ErrNotExist", err)
+	}
+	if _, err := c.Lstat("/link"); err != nil {
+		t.Errorf("Lstat of a dangling symlink after Stat: %v", err)
+	}
+
+	if _, err := c.Stat("/dir/a"); err != os.ErrNotExist {
+		t.Fatalf("Stat of a missing file: got %v, want os.ErrNotExist", err)
+	}
+	if err := c.Rename("/tmp", "/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Stat("/dir/a"); err != nil {
+		t.Errorf("Stat of a file in a directory renamed into place: %v", err)
+	}
+}
+
+// memFileServer is a fake server holding a single file in memory.
+func memFileServer(content *[]byte) func(typ byte, data []byte) encoding.BinaryMarshaler {
+	return func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, data := unmarshalUint32(data)
+		switch typ {
+		case sshFxpOpen:
+			return sshFxpHandlePacket{ID: id, Handle: "h"}
+		case sshFxpWrite:
+			_, data = unmarshalString(data)
+			offset, data := unmarshalUint64(data)
+			length, data := unmarshalUint32(data)
+			if end := int(offset) + int(length); end > len(*content) {
+				*content = append(*content, make([]byte, end-len(*content))...)
+			}
+			copy((*content)[offset:], data[:length])
+			return fakeStatus(id, sshFxOk)
+		case sshFxpRead:
+			_, data = unmarshalString(data)
+			offset, data := unmarshalUint64(data)
+			length, _ := unmarshalUint32(data)
+			if offset >= uint64(len(*content)) {
+				return fakeStatus(id, sshFxEOF)
+			}
+			b := append([]byte(nil), (*content)[offset:]...)
+			if len(b) > int(length) {
+				b = b[:length]
+			}
+			return &sshFxpDataPacket{ID: id, Length: uint32(len(b)), Data: b}
+		case sshFxpStat, sshFxpFstat:
+			return sshFxpStatResponse{ID: id, info: &fileInfo{name: "foo", size: int64(len(*content))}}
+		case sshFxpClose:
+			return fakeStatus(id, sshFxOk)
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	}
+}
+
+func TestFileReadFromFailedWrite(t *testing.T) {
+	var content []byte
+	serve := memFileServer(&content)
+	const failAt = 2048
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		if typ == sshFxpWrite {
+			id, rest := unmarshalUint32(data)
+			_, rest = unmarshalString(rest)
+			if offset, _ := unmarshalUint64(rest); offset == failAt {
+				return fakeStatus(id, sshFxFailure)
+			}
+		}
+		return serve(typ, data)
+	}, MaxPacket(1024))
+	defer c.Close()
+
+	f, err := c.OpenFile("/foo", os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	n, err := f.ReadFrom(bytes.NewReader(make([]byte, 8*1024)))
+	if !isStatusCode(err, sshFxFailure) {
+		t.Errorf("ReadFrom: want failure status, got %v", err)
+	}
+	if n != failAt {
+		t.Errorf("ReadFrom: wrote %d bytes, want %d", n, failAt)
+	}
+	if off, _ := f.Seek(0, io.SeekCurrent); off != failAt {
+		t.Errorf("offset after ReadFrom: got %d, want %d", off, failAt)
+	}
+}
+
+func TestClientWithLogger(t *testing.T) {
+	content := []byte("hello world")
+	var buf bytes.Buffer
+	c := newFakeClient(t, memFileServer(&content), WithLogger(log.New(&buf, "", 0), LogAll))
+	defer c.Close()
+
+	f, err := c.Open("/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Read(make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := "sftp: open /foo: ok\nsftp: read /foo: ok\nsftp: close /foo: ok\n"
+	if got := buf.String(); got != want {
+		t.Errorf("log:\n%s\nwant:\n%s", got, want)
+	}
+
+	buf.Reset()
+	c = newFakeClient(t, memFileServer(&content), WithLogger(log.New(&buf, "", 0), LogErrors))
+	defer c.Close()
+	if _, err := c.Stat("/foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Lstat("/foo"); err == nil {
+		t.Fatal("Lstat: want an error from the fake server")
+	}
+	if got := buf.String(); !strings.HasPrefix(got, "sftp: lstat /foo: ") || strings.Count(got, "\n") != 1 {
+		t.Errorf("log with LogErrors: got %q, want only the failed lstat", got)
+	}
+
+	// the Stat made to explain a failed create is not logged
+	buf.Reset()
+	c = newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, _ := unmarshalUint32(data)
+		return fakeStatus(id, sshFxNoSuchFile)
+	}, WithLogger(log.New(&buf, "", 0), LogAll))
+	defer c.Close()
+	if _, err := c.Create("/missing/foo"); !os.IsNotExist(err) {
+		t.Fatalf("Create in a missing directory: got %v, want an error for which os.IsNotExist", err)
+	}
+	if got, want := buf.String(), "sftp: open /missing/foo: create /missing/foo: file does not exist\n"; got != want {
+		t.Errorf("log of a failed create: got %q, want %q", got, want)
+	}
+}
+
+func TestFileWriteSparse(t *testing.T) {
+	content := make([]byte, 10000) // pre-sized, all holes
+	serve := memFileServer(&content)
+	var written []Range
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		if typ == sshFxpWrite {
+			_, rest := unmarshalUint32(data)
+			_, rest = unmarshalString(rest)
+			offset, rest := unmarshalUint64(rest)
+			length, _ := unmarshalUint32(rest)
+			written = append(written, Range{int64(offset), int64(length)})
+		}
+		return serve(typ, data)
+	}, MaxPacket(1024))
+	defer c.Close()
+
+	f, err := c.OpenFile("/foo", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ranges := []Range{{100, 3000}, {6000, 500}}
+	data := bytes.Repeat([]byte("0123456789"), 350)
+	if err := f.WriteSparse(bytes.NewReader(data), ranges); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, w := range written {
+		if !(w.Offset >= 100 && w.Offset+w.Length <= 3100) && !(w.Offset >= 6000 && w.Offset+w.Length <= 6500) {
+			t.Errorf("write of %d bytes at %d touches a hole", w.Length, w.Offset)
+		}
+	}
+	got := make([]byte, len(content))
+	if _, err := f.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, 10000)
+	copy(want[100:], data[:3000])
+	copy(want[6000:], data[3000:])
+	if !bytes.Equal(got, want) {
+		t.Error("file contents differ from the ranges written, with zeros between")
+	}
+
+	for _, bad := range [][]Range{
+		{{100, 50}, {120, 10}}, // overlapping
+		{{500, 10}, {100, 10}}, // unsorted
+		{{-1, 10}},
+	} {
+		if err := f.WriteSparse(bytes.NewReader(data), bad); err == nil {
+			t.Errorf("WriteSparse(%v): want an error", bad)
+		}
+	}
+	if err := f.WriteSparse(bytes.NewReader(data[:10]), []Range{{0, 20}}); err != io.ErrUnexpectedEOF {
+		t.Errorf("WriteSparse with short data: got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestClientMoveAcrossDevices(t *testing.T) {
+	content := []byte("contents of the file being moved")
+	files := map[string]*[]byte{"/mnt/a/src": &content}
+	modes := map[string]os.FileMode{"/mnt/a/src": 0640}
+	mtimes := map[string]uint32{"/mnt/a/src": 1234567890}
+	appearing := make(map[string]bool) // created by someone else after an Lstat
+	serve := memFilesServer(files, 1<<20)
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, rest := unmarshalUint32(data)
+		switch typ {
+		case sshFxpRename:
+			// what OpenSSH returns for EXDEV
+			return fakeStatus(id, sshFxFailure)
+		case sshFxpLstat, sshFxpStat:
+			p, _ := unmarshalString(rest)
+			content, ok := files[p]
+			if !ok || appearing[p] {
+				return fakeStatus(id, sshFxNoSuchFile)
+			}
+			return sshFxpStatResponse{ID: id, info: &fileInfo{name: path.Base(p), size: int64(len(*content)), mode: modes[p], mtime: time.Unix(int64(mtimes[p]), 0)}}
+		case sshFxpOpen:
+			p, rest := unmarshalString(rest)
+			if pflags, _ := unmarshalUint32(rest); pflags&sshFxfCreat != 0 {
+				if _, ok := files[p]; ok {
+					return fakeStatus(id, sshFxFailure)
+				}
+				files[p] = new([]byte)
+			}
+		case sshFxpSetstat:
+			p, rest := unmarshalString(rest)
+			flags, rest := unmarshalUint32(rest)
+			if flags&sshFileXferAttrPermissions != 0 {
+				mode, _ := unmarshalUint32(rest)
+				modes[p] = os.FileMode(mode)
+			}
+			if flags&sshFileXferAttrACmodTime != 0 {
+				_, rest = unmarshalUint32(rest)
+				mtimes[p], _ = unmarshalUint32(rest)
+			}
+			return fakeStatus(id, sshFxOk)
+		case sshFxpRemove:
+			p, _ := unmarshalString(rest)
+			delete(files, p)
+			return fakeStatus(id, sshFxOk)
+		}
+		return serve(typ, data)
+	})
+	defer c.Close()
+
+	if err := c.Move("/mnt/a/src", "/mnt/b/dst"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := files["/mnt/a/src"]; ok {
+		t.Error("source was not removed")
+	}
+	dst, ok := files["/mnt/b/dst"]
+	if !ok {
+		t.Fatal("destination was not created")
+	}
+	if string(*dst) != "contents of the file being moved" {
+		t.Errorf("destination holds %q", *dst)
+	}
+	if modes["/mnt/b/dst"] != 0640 || mtimes["/mnt/b/dst"] != 1234567890 {
+		t.Errorf("destination has mode %v and mtime %d, want -rw-r----- and 1234567890", modes["/mnt/b/dst"], mtimes["/mnt/b/dst"])
+	}
+
+	// an existing target makes the rename fail too, but is not overwritten
+	other := []byte("other")
+	files["/mnt/a/src"] = &other
+	if err := c.Move("/mnt/a/src", "/mnt/b/dst"); !isStatusCode(err, sshFxFailure) {
+		t.Errorf("Move onto an existing file: got %v, want the rename failure", err)
+	}
+	if string(*files["/mnt/b/dst"]) != "contents of the file being moved" {
+		t.Error("existing destination was overwritten")
+	}
+
+	// nor is a target created between the Lstat and the copy removed
+	files["/mnt/b/late"] = &other
+	appearing["/mnt/b/late"] = true
+	if err := c.Move("/mnt/a/src", "/mnt/b/late"); !isStatusCode(err, sshFxFailure) {
+		t.Errorf("Move onto a file created meanwhile: got %v, want the open failure", err)
+	}
+	if _, ok := files["/mnt/b/late"]; !ok {
+		t.Error("destination created meanwhile was removed")
+	}
+}
+
+func TestFileSetRateLimit(t *testing.T) {
+	const size, rate = 50000, 200000
+	const minimum = time.Duration(size) * time.Second / rate
+	var content []byte
+	c := newFakeClient(t, memFileServer(&content), MaxPacket(1024))
+	defer c.Close()
+
+	f, err := c.OpenFile("/foo", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.SetRateLimit(rate)
+
+	start := time.Now()
+	if _, err := f.Write(make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < minimum {
+		t.Errorf("wrote %d bytes in %v at %d bytes/s, want at least %v", size, elapsed, rate, minimum)
+	}
+
+	start = time.Now()
+	if _, err := f.ReadAt(make([]byte, size), 0); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < minimum {
+		t.Errorf("read %d bytes in %v at %d bytes/s, want at least %v", size, elapsed, rate, minimum)
+	}
+
+	f.SetRateLimit(0)
+	start = time.Now()
+	if _, err := f.ReadAt(make([]byte, size), 0); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= minimum {
+		t.Errorf("read took %v after the limit was removed", elapsed)
+	}
+}
+
+func TestClientHead(t *testing.T) {
+	content := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 5000)...)
+	serve := memFileServer(&content)
+	var reads int
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		if typ == sshFxpRead {
+			reads++
+		}
+		return serve(typ, data)
+	}, MaxPacket(1024))
+	defer c.Close()
+
+	magic, err := c.Head("/image", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(magic) != "\x89PNG" {
+		t.Errorf("Head: got %q, want the PNG magic number", magic)
+	}
+	if reads != 1 {
+		t.Errorf("Head of 4 bytes sent %d reads, want 1", reads)
+	}
+
+	reads = 0
+	all, err := c.Head("/image", 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(all, content) {
+		t.Errorf("Head past the end: got %d bytes, want the %d of the file", len(all), len(content))
+	}
+	if max := (10000 + 1023) / 1024; reads > max {
+		t.Errorf("Head of 10000 bytes sent %d reads, want at most %d", reads, max)
+	}
+
+	if b, err := c.Head("/image", 0); err != nil || len(b) != 0 {
+		t.Errorf("Head of 0 bytes: got %q, %v, want nothing", b, err)
+	}
+	if _, err := c.Head("/image", -1); err == nil {
+		t.Error("Head of -1 bytes: want an error")
+	}
+}
+
+func TestClientContentType(t *testing.T) {
+	for _, tt := range []struct {
+		content []byte
+		want    string
+	}{
+		{append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 2000)...), "image/png"},
+		{bytes.Repeat([]byte("plain text\n"), 100), "text/plain; charset=utf-8"},
+		{nil, "application/octet-stream"},
+	} {
+		content := tt.content
+		c := newFakeClient(t, memFileServer(&content))
+		got, err := c.ContentType("/f")
+		c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("ContentType of %q...: got %q, want %q", tt.content[:min(len(tt.content), 8)], got, tt.want)
+		}
+	}
+}
+
+func TestFileStats(t *testing.T) {
+	const size = 100000
+	var content []byte
+	c := newFakeClient(t, memFileServer(&content), MaxPacket(1024))
+	defer c.Close()
+
+	f, err := c.OpenFile("/foo", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	want := FileStats{BytesWritten: size, WriteRequests: (size + 1023) / 1024}
+	if got := f.Stats(); got != want {
+		t.Errorf("after Write: got %+v, want %+v", got, want)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	n, err := f.WriteTo(ioutil.Discard)
+	if err != nil || n != size {
+		t.Fatalf("WriteTo: %d, %v", n, err)
+	}
+	got := f.Stats()
+	if got.BytesRead != size {
+		t.Errorf("after WriteTo: BytesRead = %d, want %d", got.BytesRead, size)
+	}
+	if got.ReadRequests < (size+1023)/1024 {
+		t.Errorf("after WriteTo: ReadRequests = %d, want at least %d", got.ReadRequests, (size+1023)/1024)
+	}
+	if got.BytesWritten != want.BytesWritten || got.WriteRequests != want.WriteRequests {
+		t.Errorf("after WriteTo: write counters changed: %+v", got)
+	}
+}
+
+func TestFileCancelPending(t *testing.T) {
+	slowRead := make(chan uint32, 1)
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, data := unmarshalUint32(data)
+		switch typ {
+		case sshFxpOpen:
+			p, _ := unmarshalString(data)
+			return sshFxpHandlePacket{ID: id, Handle: p}
+		case sshFxpRead:
+			handle, _ := unmarshalString(data)
+			if handle == "/slow" {
+				// stall: the reply only comes with the next fast read
+				slowRead <- id
+				return nil
+			}
+			reply := &sshFxpDataPacket{ID: id, Length: 4, Data: []byte("fast")}
+			select {
+			case late := <-slowRead:
+				return fakeReplies{&sshFxpDataPacket{ID: late, Length: 4, Data: []byte("late")}, reply}
+			default:
+				return reply
+			}
+		case sshFxpClose:
+			return fakeStatus(id, sshFxOk)
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	})
+	defer c.Close()
+
+	slow, err := c.Open("/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fast, err := c.Open("/fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := slow.Read(make([]byte, 4))
+		done <- err
+	}()
+	// wait for the read to reach the server, then put it back for the
+	// handler to answer late
+	id := <-slowRead
+	slowRead <- id
+
+	fast.CancelPending() // nothing pending, must not affect slow
+	select {
+	case err := <-done:
+		t.Fatalf("slow Read returned %v when another file was cancelled", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	slow.CancelPending()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("cancelled Read: want %v, got %v", context.Canceled, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled Read did not return")
+	}
+
+	// the late reply to the cancelled read is dropped, and the other file
+	// goes on working
+	for i := 0; i < 2; i++ {
+		b := make([]byte, 4)
+		if n, err := fast.Read(b); err != nil || string(b[:n]) != "fast" {
+			t.Fatalf("fast Read: %q, %v", b[:n], err)
+		}
+	}
+}
+
+func TestFileWriteToOutOfOrderCount(t *testing.T) {
+	content := make([]byte, 10*1024)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	serve := memFileServer(&content)
+	var reads int
+	var held encoding.BinaryMarshaler
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		if typ != sshFxpRead {
+			return serve(typ, data)
+		}
+		reads++
+		reply := serve(typ, data)
+		switch reads {
+		case 2:
+			// answer the second read after the third, so that the third
+			// waits in WriteTo's buffer for the second
+			held = reply
+			return nil
+		case 3:
+			return fakeReplies{reply, held}
+		}
+		return reply
+	}, MaxPacket(1024))
+	defer c.Close()
+
+	f, err := c.Open("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var buf bytes.Buffer
+	n, err := f.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) || n != int64(len(content)) {
+		t.Errorf("WriteTo returned %d after writing %d bytes of %d", n, buf.Len(), len(content))
+	}
+	if !bytes.Equal(buf.Bytes(), content) {
+		t.Error("WriteTo wrote the file out of order")
+	}
+}
+
+func TestClientOpenPath(t *testing.T) {
+	var opened []string
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, data := unmarshalUint32(data)
+		switch typ {
+		case sshFxpOpen:
+			p, _ := unmarshalString(data)
+			opened = append(opened, p)
+			return sshFxpHandlePacket{ID: id, Handle: p}
+		}
+		return fakeStatus(id, sshFxOk)
+	})
+	defer c.Close()
+
+	if _, err := c.Open(""); err != ErrBadPath {
+		t.Errorf("Open(\"\"): want %v, got %v", ErrBadPath, err)
+	}
+	if _, err := c.Create(""); err != ErrBadPath {
+		t.Errorf("Create(\"\"): want %v, got %v", ErrBadPath, err)
+	}
+	if _, err := c.OpenFile("", os.O_RDONLY); err != ErrBadPath {
+		t.Errorf("OpenFile(\"\"): want %v, got %v", ErrBadPath, err)
+	}
+	if len(opened) != 0 {
+		t.Fatalf("empty paths were sent to the server: %q", opened)
+	}
+
+	for _, tt := range []struct{ in, want string }{
+		{"./foo", "foo"},
+		{"././foo", "foo"},
+		{".//foo/./bar", "foo/./bar"},
+		{"foo", "foo"},
+		{"/abs", "/abs"},
+		{"./", "."},
+	} {
+		opened = nil
+		f, err := c.Open(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(opened) != 1 || opened[0] != tt.want {
+			t.Errorf("Open(%q) sent %q, want %q", tt.in, opened, tt.want)
+		}
+		if f.Name() != tt.in {
+			t.Errorf("Open(%q) named the file %q", tt.in, f.Name())
+		}
+		f.Close()
+	}
+}
+
+func TestClientReadDirNamesVerbatim(t *testing.T) {
+	// the filename field is used as is, spaces and all; the padded longname
+	// is never looked at
+	names := []string{"two words.txt", " leading", "trailing ", "tab\there"}
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, data := unmarshalUint32(data)
+		switch typ {
+		case sshFxpOpendir:
+			return sshFxpHandlePacket{ID: id, Handle: "dir"}
+		case sshFxpReaddir:
+			if names == nil {
+				return fakeStatus(id, sshFxEOF)
+			}
+			var attrs []sshFxpNameAttr
+			for _, name := range names {
+				fi := fileInfoFromStat(&FileStat{Mode: 0100644}, name)
+				longname := fmt.Sprintf("-rw-r--r--    1 user  group  0 Jan  1 00:00 %s      ", name)
+				attrs = append(attrs, sshFxpNameAttr{Name: name, LongName: longname, Attrs: []interface{}{fi}})
+			}
+			names = nil
+			return sshFxpNamePacket{ID: id, NameAttrs: attrs}
+		}
+		return fakeStatus(id, sshFxOk)
+	})
+	defer c.Close()
+
+	want := append([]string(nil), names...)
+	fis, err := c.ReadDir("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, fi := range fis {
+		got = append(got, fi.Name())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDir names: got %q, want %q", got, want)
+	}
+}
+
+func TestClientCreateModeChecked(t *testing.T) {
+	const umask = 022
+	var mode uint32
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, data := unmarshalUint32(data)
+		switch typ {
+		case sshFxpOpen:
+			_, data = unmarshalString(data)
+			_, data = unmarshalUint32(data) // pflags
+			flags, data := unmarshalUint32(data)
+			mode = 0666
+			if flags&sshFileXferAttrPermissions != 0 {
+				mode, _ = unmarshalUint32(data)
+			}
+			mode = mode&^umask | 0100000
+			return sshFxpHandlePacket{ID: id, Handle: "h"}
+		case sshFxpFstat:
+			return sshFxpStatResponse{ID: id, info: fileInfoFromStat(&FileStat{Mode: mode}, "foo")}
+		case sshFxpClose:
+			return fakeStatus(id, sshFxOk)
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	})
+	defer c.Close()
+
+	for _, tt := range []struct{ perm, want os.FileMode }{
+		{0666, 0644},
+		{0600, 0600},
+		{0777, 0755},
+	} {
+		f, got, err := c.CreateModeChecked("/foo", tt.perm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if !got.IsRegular() || got.Perm() != tt.want {
+			t.Errorf("CreateModeChecked(%v): got mode %v, want %v", tt.perm, got, tt.want)
+		}
+	}
+}
+
+func TestClientCreateModeCheckedExisting(t *testing.T) {
+	modes := map[string]uint32{"/existing": 0600}
+	var setstats int
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, rest := unmarshalUint32(data)
+		switch typ {
+		case sshFxpOpen:
+			p, rest := unmarshalString(rest)
+			pflags, rest := unmarshalUint32(rest)
+			if _, ok := modes[p]; !ok && pflags&sshFxfCreat != 0 {
+				// like a real server, only a file it creates gets the mode
+				modes[p] = 0
+				if flags, rest := unmarshalUint32(rest); flags&sshFileXferAttrPermissions != 0 {
+					modes[p], _ = unmarshalUint32(rest)
+				}
+			}
+			return sshFxpHandlePacket{ID: id, Handle: p}
+		case sshFxpFstat:
+			p, _ := unmarshalString(rest)
+			return sshFxpStatResponse{ID: id, info: &fileInfo{name: path.Base(p), mode: os.FileMode(modes[p])}}
+		case sshFxpSetstat, sshFxpFsetstat:
+			setstats++
+			return fakeStatus(id, sshFxOk)
+		case sshFxpClose:
+			return fakeStatus(id, sshFxOk)
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	})
+	defer c.Close()
+
+	for _, tt := range []struct {
+		path string
+		want os.FileMode
+	}{
+		{"/existing", 0600},
+		{"/new", 0644},
+	} {
+		f, mode, err := c.CreateModeChecked(tt.path, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if mode.Perm() != tt.want {
+			t.Errorf("%s has mode %v after CreateModeChecked, want %v", tt.path, mode.Perm(), tt.want)
+		}
+	}
+	if setstats != 0 {
+		t.Errorf("CreateModeChecked sent %d SETSTAT requests, want none", setstats)
+	}
+}
+
+func TestClientReadDirContinue(t *testing.T) {
+	const entries, perBatch = 10, 3
+	// a fresh fake server for each (re)connection, listing the same
+	// directory in batches; opens counts OPENDIRs across all of them
+	var opens int
+	connect := func() *Client {
+		var pos int
+		return newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+			id, _ := unmarshalUint32(data)
+			switch typ {
+			case sshFxpOpendir:
+				opens++
+				pos = 0
+				return sshFxpHandlePacket{ID: id, Handle: "dir"}
+			case sshFxpReaddir:
+				if pos == entries {
+					return fakeStatus(id, sshFxEOF)
+				}
+				var names []sshFxpNameAttr
+				for ; pos < entries && len(names) < perBatch; pos++ {
+					name := fmt.Sprintf("file%d", pos)
+					fi := fileInfoFromStat(&FileStat{Mode: 0100644}, name)
+					names = append(names, sshFxpNameAttr{Name: name, LongName: name, Attrs: []interface{}{fi}})
+				}
+				return sshFxpNamePacket{ID: id, NameAttrs: names}
+			case sshFxpClose:
+				return fakeStatus(id, sshFxOk)
+			}
+			return fakeStatus(id, sshFxOPUnsupported)
+		})
+	}
+
+	seen := map[string]bool{}
+	var listed []string
+	// list two batches, then lose the connection
+	c := connect()
+	handle, err := c.OpenDir("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		batch, err := c.ReadDirContinue(handle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fi := range batch {
+			seen[fi.Name()] = true
+			listed = append(listed, fi.Name())
+		}
+	}
+	c.Close()
+	if len(listed) != 2*perBatch {
+		t.Fatalf("listed %d entries before the interruption, want %d", len(listed), 2*perBatch)
+	}
+
+	// resume on a new connection, skipping what was already seen
+	c = connect()
+	defer c.Close()
+	handle, err = c.OpenDir("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		batch, err := c.ReadDirContinue(handle)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fi := range batch {
+			if !seen[fi.Name()] {
+				seen[fi.Name()] = true
+				listed = append(listed, fi.Name())
+			}
+		}
+	}
+	if err := c.CloseDir(handle); err != nil {
+		t.Fatal(err)
+	}
+
+	if opens != 2 {
+		t.Errorf("directory opened %d times, want 2", opens)
+	}
+	if len(listed) != entries {
+		t.Fatalf("listed %d entries in all, want %d: %v", len(listed), entries, listed)
+	}
+	for i, name := range listed {
+		if want := fmt.Sprintf("file%d", i); name != want {
+			t.Errorf("entry %d is %q, want %q", i, name, want)
+		}
+	}
+}
+
+func TestClientMkdirExistingOK(t *testing.T) {
+	handler := func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, _ := unmarshalUint32(data)
+		switch typ {
+		case sshFxpMkdir:
+			return fakeStatus(id, sshFxFailure)
+		case sshFxpStat, sshFxpLstat:
+			return sshFxpStatResponse{ID: id, info: &fileInfo{name: "dir", mode: os.ModeDir | 0755}}
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	}
+
+	c := newFakeClient(t, handler)
+	defer c.Close()
+	if err := c.Mkdir("/dir"); !isStatusCode(err, sshFxFailure) {
+		t.Errorf("Mkdir of an existing directory: got %v, want the failure status", err)
+	}
+
+	c = newFakeClient(t, handler, MkdirExistingOK(true))
+	defer c.Close()
+	if err := c.Mkdir("/dir"); err != nil {
+		t.Errorf("Mkdir of an existing directory with MkdirExistingOK: %v", err)
+	}
+}
+
+func TestClientReadDirSorted(t *testing.T) {
+	// the server lists the entries in two batches, neither in name order
+	batches := [][]string{{"zeta", "alpha", "mu"}, {"beta", "Omega"}}
+	var sent int
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, _ := unmarshalUint32(data)
+		switch typ {
+		case sshFxpOpendir:
+			sent = 0
+			return sshFxpHandlePacket{ID: id, Handle: "d"}
+		case sshFxpReaddir:
+			if sent == len(batches) {
+				return fakeStatus(id, sshFxEOF)
+			}
+			var names []sshFxpNameAttr
+			for _, name := range batches[sent] {
+				names = append(names, sshFxpNameAttr{Name: name, LongName: name, Attrs: []interface{}{&fileInfo{name: name}}})
+			}
+			sent++
+			return sshFxpNamePacket{ID: id, NameAttrs: names}
+		case sshFxpClose:
+			return fakeStatus(id, sshFxOk)
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	})
+	defer c.Close()
+
+	fis, err := c.ReadDirSorted("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, fi := range fis {
+		got = append(got, fi.Name())
+	}
+	want := []string{"Omega", "alpha", "beta", "mu", "zeta"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDirSorted listed %v, want %v", got, want)
+	}
+}
+
+func TestClientTinyMaxPacket(t *testing.T) {
+	const maxPacket = 32
+	var content []byte
+	serve := memFileServer(&content)
+	var oversized int
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		switch typ {
+		case sshFxpRead, sshFxpWrite:
+			_, rest := unmarshalUint32(data)
+			_, rest = unmarshalString(rest)
+			_, rest = unmarshalUint64(rest)
+			if length, _ := unmarshalUint32(rest); length > maxPacket {
+				oversized++
+			}
+		}
+		return serve(typ, data)
+	}, MaxPacket(maxPacket))
+	defer c.Close()
+
+	want := make([]byte, 1024)
+	for i := range want {
+		want[i] = byte(i * 13)
+	}
+
+	f, err := c.OpenFile("/foo", os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if n, err := f.Write(want); err != nil || n != len(want) {
+		t.Fatalf("Write: %d, %v", n, err)
+	}
+	if !bytes.Equal(content, want) {
+		t.Fatalf("Write stored the wrong contents")
+	}
+
+	content = nil
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := f.ReadFrom(bytes.NewReader(want)); err != nil || n != int64(len(want)) {
+		t.Fatalf("ReadFrom: %d, %v", n, err)
+	}
+	if !bytes.Equal(content, want) {
+		t.Fatalf("ReadFrom stored the wrong contents")
+	}
+
+	got := make([]byte, len(want))
+	if n, err := f.ReadAt(got, 0); err != nil || n != len(want) {
+		t.Fatalf("ReadAt: %d, %v", n, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("ReadAt returned the wrong contents")
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if n, err := f.WriteTo(&buf); err != nil || n != int64(len(want)) {
+		t.Fatalf("WriteTo: %d, %v", n, err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("WriteTo returned the wrong contents")
+	}
+
+	if fi, err := f.Stat(); err != nil || fi.Size() != int64(len(want)) {
+		t.Errorf("Stat: %v, %v", fi, err)
+	}
+	if oversized > 0 {
+		t.Errorf("%d reads or writes were larger than MaxPacket", oversized)
+	}
+}
+
+func TestClientServerVendor(t *testing.T) {
+	handler := func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, _ := unmarshalUint32(data)
+		return fakeStatus(id, sshFxOPUnsupported)
+	}
+
+	vendor := marshalString(nil, "Example Corp")
+	vendor = marshalString(vendor, "ExampleSFTPd")
+	vendor = marshalString(vendor, "4.2.1")
+	vendor = marshalUint64(vendor, 421)
+	c := newFakeClientExt(t, []sshExtensionPair{{"vendor-id", string(vendor)}}, handler)
+	defer c.Close()
+	name, version, ok := c.ServerVendor()
+	if !ok || name != "ExampleSFTPd" || version != "4.2.1" {
+		t.Errorf("ServerVendor() = %q, %q, %v; want ExampleSFTPd, 4.2.1, true", name, version, ok)
+	}
+
+	// a truncated vendor-id is not reported
+	c = newFakeClientExt(t, []sshExtensionPair{{"vendor-id", string(vendor[:20])}}, handler)
+	defer c.Close()
+	if _, _, ok := c.ServerVendor(); ok {
+		t.Errorf("ServerVendor() reported a truncated vendor-id")
+	}
+
+	c = newFakeClient(t, handler)
+	defer c.Close()
+	if _, _, ok := c.ServerVendor(); ok {
+		t.Errorf("ServerVendor() reported a vendor the server did not send")
+	}
+}
+
+func TestClientHandleTrailingNulls(t *testing.T) {
+	// handles are opaque bytes, and must be echoed back exactly
+	const handle = "fh \x00\x00"
+	content := []byte("contents")
+	serve := memFileServer(&content)
+	var mismatched int
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, rest := unmarshalUint32(data)
+		switch typ {
+		case sshFxpOpen, sshFxpOpendir:
+			return sshFxpHandlePacket{ID: id, Handle: handle}
+		case sshFxpRead, sshFxpWrite, sshFxpFstat, sshFxpClose, sshFxpReaddir:
+			if h, _ := unmarshalString(rest); h != handle {
+				mismatched++
+				return fakeStatus(id, sshFxInvalidHandle)
+			}
+			if typ == sshFxpReaddir {
+				return fakeStatus(id, sshFxEOF)
+			}
+		}
+		return serve(typ, data)
+	})
+	defer c.Close()
+
+	f, err := c.OpenFile("/foo", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("new ")); err != nil {
+		t.Error(err)
+	}
+	if _, err := f.ReadAt(make([]byte, 4), 4); err != nil {
+		t.Error(err)
+	}
+	if _, err := f.Stat(); err != nil {
+		t.Error(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Error(err)
+	}
+
+	h, err := c.OpenDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h != handle {
+		t.Errorf("OpenDir returned handle %q, want %q", h, handle)
+	}
+	if _, err := c.ReadDirContinue(h); err != io.EOF {
+		t.Errorf("ReadDirContinue: got %v, want io.EOF", err)
+	}
+	if err := c.CloseDir(h); err != nil {
+		t.Error(err)
+	}
+	if mismatched > 0 {
+		t.Errorf("%d requests did not echo the handle exactly", mismatched)
+	}
+}
+
+func TestClientOpenResolved(t *testing.T) {
+	target := []byte("the target")
+	files := map[string]*[]byte{"/data/target": &target}
+	links := map[string]string{
+		"/a":          "b",            // relative to /
+		"/b":          "/data/target", // absolute
+		"/loop/one":   "two",
+		"/loop/two":   "/loop/one",
+		"/dangling":   "/nowhere",
+		"/data/alias": "target",
+	}
+	serve := memFilesServer(files, 1<<20)
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, rest := unmarshalUint32(data)
+		p, _ := unmarshalString(rest)
+		switch typ {
+		case sshFxpLstat:
+			if _, ok := links[p]; ok {
+				return sshFxpStatResponse{ID: id, info: &fileInfo{name: path.Base(p), mode: os.ModeSymlink | 0777}}
+			}
+			if content, ok := files[p]; ok {
+				return sshFxpStatResponse{ID: id, info: &fileInfo{name: path.Base(p), size: int64(len(*content))}}
+			}
+			return fakeStatus(id, sshFxNoSuchFile)
+		case sshFxpReadlink:
+			return sshFxpNamePacket{ID: id, NameAttrs: []sshFxpNameAttr{{Name: links[p], LongName: links[p], Attrs: []interface{}{&fileInfo{}}}}}
+		}
+		return serve(typ, data)
+	})
+	defer c.Close()
+
+	for _, p := range []string{"/a", "/data/alias", "/data/target"} {
+		f, err := c.OpenResolved(p)
+		if err != nil {
+			t.Fatalf("OpenResolved(%q): %v", p, err)
+		}
+		got, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil || !bytes.Equal(got, target) {
+			t.Errorf("OpenResolved(%q) read %q, %v; want %q", p, got, err, target)
+		}
+	}
+
+	if _, err := c.OpenResolved("/loop/one"); err != ErrTooManyLinks {
+		t.Errorf("OpenResolved of a loop: got %v, want ErrTooManyLinks", err)
+	}
+	if _, err := c.OpenResolved("/dangling"); err != os.ErrNotExist {
+		t.Errorf("OpenResolved of a dangling link: got %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestClientAlignReads(t *testing.T) {
+	content := make([]byte, 20000)
+	serve := memFileServer(&content)
+	newClient := func(lengths map[uint32]int, opts ...ClientOption) *Client {
+		exts := []sshExtensionPair{{"statvfs@openssh.com", "2"}}
+		return newFakeClientExt(t, exts, func(typ byte, data []byte) encoding.BinaryMarshaler {
+			id, rest := unmarshalUint32(data)
+			switch typ {
+			case sshFxpExtended:
+				return &StatVFS{ID: id, Bsize: 4096, Frsize: 1000}
+			case sshFxpRead:
+				_, rest = unmarshalString(rest)
+				_, rest = unmarshalUint64(rest)
+				length, _ := unmarshalUint32(rest)
+				lengths[length]++
+			}
+			return serve(typ, data)
+		}, opts...)
+	}
+
+	for _, tt := range []struct {
+		align bool
+		want  uint32
+	}{
+		{false, 4096},
+		{true, 4000},
+	} {
+		lengths := make(map[uint32]int)
+		c := newClient(lengths, MaxPacket(4096), AlignReads(tt.align))
+		f, err := c.Open("/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.ReadAt(make([]byte, 16000), 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteTo(ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		c.Close()
+		if lengths[tt.want] == 0 {
+			t.Errorf("AlignReads(%v): no reads of %d bytes: %v", tt.align, tt.want, lengths)
+		}
+		for length := range lengths {
+			// the last read of ReadAt is only what is left of the buffer
+			if length != tt.want && length != 16000%tt.want {
+				t.Errorf("AlignReads(%v): reads of %d bytes, want %d: %v", tt.align, length, tt.want, lengths)
+			}
+		}
+	}
+}
+
+func TestFileWriteToReadRetries(t *testing.T) {
+	content := make([]byte, 32*1024)
+	for i := range content {
+		content[i] = byte(i * 31)
+	}
+	const failAt = 5 * 1024
+	newClient := func(opts ...ClientOption) *Client {
+		serve := memFileServer(&content)
+		failures := 2
+		return newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+			if typ == sshFxpRead {
+				id, rest := unmarshalUint32(data)
+				_, rest = unmarshalString(rest)
+				if offset, _ := unmarshalUint64(rest); offset == failAt && failures > 0 {
+					failures--
+					return fakeStatus(id, sshFxFailure)
+				}
+			}
+			return serve(typ, data)
+		}, append(opts, MaxPacket(1024))...)
+	}
+
+	c := newClient()
+	f, err := c.Open("/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteTo(ioutil.Discard); !isStatusCode(err, sshFxFailure) {
+		t.Errorf("WriteTo without retries: got %v, want the failure status", err)
+	}
+	f.Close()
+	c.Close()
+
+	c = newClient(ReadRetries(2))
+	defer c.Close()
+	f, err = c.Open("/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var buf bytes.Buffer
+	if n, err := f.WriteTo(&buf); err != nil || n != int64(len(content)) {
+		t.Fatalf("WriteTo with retries: %d, %v", n, err)
+	}
+	if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("WriteTo with retries returned the wrong contents")
+	}
+	if st := f.Stats(); st.Retries != 2 {
+		t.Errorf("%d reads retried, want 2", st.Retries)
+	}
+}
+
+func TestClientRepliesOutOfOrder(t *testing.T) {
+	const n = 16
+	var held fakeReplies
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, rest := unmarshalUint32(data)
+		if typ != sshFxpStat {
+			return fakeStatus(id, sshFxOPUnsupported)
+		}
+		p, _ := unmarshalString(rest)
+		var i int
+		fmt.Sscanf(p, "/f%d", &i)
+		held = append(held, sshFxpStatResponse{ID: id, info: &fileInfo{name: path.Base(p), size: int64(i)}})
+		if len(held) < n {
+			return nil
+		}
+		// answer every request at once, last first, with the odd ones
+		// before the even ones
+		var replies fakeReplies
+		for odd := 1; odd >= 0; odd-- {
+			for j := len(held) - 1; j >= 0; j-- {
+				if j%2 == odd {
+					replies = append(replies, held[j])
+				}
+			}
+		}
+		held = nil
+		return replies
+	})
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fi, err := c.Stat(fmt.Sprintf("/f%d", i))
+			switch {
+			case err != nil:
+				errs <- err
+			case fi.Size() != int64(i):
+				errs <- fmt.Errorf("Stat(/f%d) got the reply for /f%d", i, fi.Size())
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestClientReadDirOfFile(t *testing.T) {
+	for _, failOpen := range []bool{true, false} {
+		c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+			id, rest := unmarshalUint32(data)
+			switch typ {
+			case sshFxpOpendir:
+				if failOpen {
+					return fakeStatus(id, sshFxFailure)
+				}
+				p, _ := unmarshalString(rest)
+				return sshFxpHandlePacket{ID: id, Handle: p}
+			case sshFxpReaddir:
+				return fakeStatus(id, sshFxFailure)
+			case sshFxpStat:
+				p, _ := unmarshalString(rest)
+				mode := os.FileMode(0644)
+				if p == "/dir" {
+					mode |= os.ModeDir
+				}
+				return sshFxpStatResponse{ID: id, info: &fileInfo{name: path.Base(p), mode: mode}}
+			case sshFxpClose:
+				return fakeStatus(id, sshFxOk)
+			}
+			return fakeStatus(id, sshFxOPUnsupported)
+		})
+
+		_, err := c.ReadDir("/file")
+		if perr, ok := err.(*os.PathError); !ok || perr.Err != syscall.ENOTDIR || perr.Path != "/file" {
+			t.Errorf("ReadDir of a file, failing at OPENDIR %v: got %#v, want ENOTDIR", failOpen, err)
+		}
+		// a directory which cannot be listed keeps the server's error
+		if _, err := c.ReadDir("/dir"); !isStatusCode(err, sshFxFailure) {
+			t.Errorf("ReadDir of a directory, failing at OPENDIR %v: got %v, want the failure status", failOpen, err)
+		}
+		c.Close()
+	}
+}
+
+func TestClientReadDirClosesOnError(t *testing.T) {
+	var readdirs int
+	var closed []string
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, rest := unmarshalUint32(data)
+		switch typ {
+		case sshFxpOpendir:
+			return sshFxpHandlePacket{ID: id, Handle: "dirhandle"}
+		case sshFxpReaddir:
+			readdirs++
+			if readdirs > 1 {
+				return fakeStatus(id, sshFxFailure)
+			}
+			names := []sshFxpNameAttr{{Name: "a", LongName: "a", Attrs: []interface{}{&fileInfo{name: "a"}}}}
+			return sshFxpNamePacket{ID: id, NameAttrs: names}
+		case sshFxpClose:
+			h, _ := unmarshalString(rest)
+			closed = append(closed, h)
+			return fakeStatus(id, sshFxOk)
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	})
+	defer c.Close()
+
+	if _, err := c.ReadDir("/dir"); !isStatusCode(err, sshFxFailure) {
+		t.Fatalf("ReadDir: got %v, want the failure of the second READDIR", err)
+	}
+	if !reflect.DeepEqual(closed, []string{"dirhandle"}) {
+		t.Errorf("closed handles %q, want the directory handle once", closed)
+	}
+}
+
+func TestFileReadWriteSeeker(t *testing.T) {
+	var content []byte
+	c := newFakeClient(t, memFileServer(&content), MaxPacket(1024))
+	defer c.Close()
+	f, err := c.OpenFile("/archive", os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// write a placeholder header and a body, then read the header back
+	// and rewrite it with the body's length, as an archive writer would
+	var rws io.ReadWriteSeeker = f
+	body := bytes.Repeat([]byte("body"), 1000)
+	if _, err := rws.Write([]byte("LEN:00000000\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rws.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rws.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(rws, header); err != nil || string(header) != "LEN:" {
+		t.Fatalf("read header %q, %v", header, err)
+	}
+	if _, err := rws.Write([]byte(fmt.Sprintf("%08d", len(body)))); err != nil {
+		t.Fatal(err)
+	}
+	end, err := rws.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if end != int64(13+len(body)) {
+		t.Errorf("Seek to the end: %d, want %d", end, 13+len(body))
+	}
+	if _, err := rws.Write([]byte("trailer")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := append(append([]byte(fmt.Sprintf("LEN:%08d\n", len(body))), body...), "trailer"...)
+	if !bytes.Equal(content, want) {
+		t.Errorf("file holds %q..., want %q...", content[:16], want[:16])
+	}
+}
+
+// rawReply is a reply of a fake server given as its bytes, type first.
+type rawReply []byte
+
+func (p rawReply) MarshalBinary() ([]byte, error) { return p, nil }
+
+func TestClientNameCountTooLarge(t *testing.T) {
+	// a NAME reply claiming many more entries than it holds
+	nameReply := func(id, count uint32, entries int) rawReply {
+		b := marshalUint32([]byte{sshFxpName}, id)
+		b = marshalUint32(b, count)
+		for i := 0; i < entries; i++ {
+			b = marshalString(b, "name")
+			b = marshalString(b, "long name")
+			b = marshalUint32(b, 0) // no attributes
+		}
+		return b
+	}
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, _ := unmarshalUint32(data)
+		switch typ {
+		case sshFxpOpendir:
+			return sshFxpHandlePacket{ID: id, Handle: "d"}
+		case sshFxpReaddir:
+			return nameReply(id, 1<<30, 1)
+		case sshFxpReadlink, sshFxpRealpath:
+			// one entry is claimed, but its name runs past the end
+			b := marshalUint32([]byte{sshFxpName}, id)
+			b = marshalUint32(b, 1)
+			b = marshalUint32(b, 1000)
+			return rawReply(append(b, make([]byte, minNameEntrySize)...))
+		case sshFxpClose:
+			return fakeStatus(id, sshFxOk)
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	})
+	defer c.Close()
+
+	if _, err := c.ReadDir("/d"); err != errShortPacket {
+		t.Errorf("ReadDir: got %v, want errShortPacket", err)
+	}
+	if _, err := c.ReadLink("/l"); err != errShortPacket {
+		t.Errorf("ReadLink: got %v, want errShortPacket", err)
+	}
+	if _, err := c.Getwd(); err != errShortPacket {
+		t.Errorf("Getwd: got %v, want errShortPacket", err)
+	}
+}
+
+func TestClientReadFileLimit(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	serve := memFileServer(&content)
+	var lie bool
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		if typ == sshFxpStat && lie {
+			// claim the file is small, and then stream all of it
+			id, _ := unmarshalUint32(data)
+			return sshFxpStatResponse{ID: id, info: &fileInfo{name: "f", size: 10}}
+		}
+		return serve(typ, data)
+	}, MaxPacket(1024))
+	defer c.Close()
+
+	got, err := c.ReadFileLimit("/f", int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("ReadFileLimit returned %d bytes, want the %d of the file", len(got), len(content))
+	}
+
+	for _, lie = range []bool{false, true} {
+		if got, err := c.ReadFileLimit("/f", 5000); err != ErrFileTooLarge {
+			t.Errorf("ReadFileLimit past the limit, size lied about %v: got %d bytes, %v; want ErrFileTooLarge", lie, len(got), err)
+		}
+	}
+}
+
+func TestClientBarrier(t *testing.T) {
+	var held fakeReplies
+	bothHeld := make(chan struct{})
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, rest := unmarshalUint32(data)
+		switch typ {
+		case sshFxpOpen:
+			p, _ := unmarshalString(rest)
+			return sshFxpHandlePacket{ID: id, Handle: p}
+		case sshFxpWrite:
+			// hold the acks back until the next stat
+			held = append(held, fakeStatus(id, sshFxOk))
+			if len(held) == 2 {
+				close(bothHeld)
+			}
+			return nil
+		case sshFxpStat:
+			replies := append(held, sshFxpStatResponse{ID: id, info: &fileInfo{name: "f"}})
+			held = nil
+			return replies
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	})
+	defer c.Close()
+
+	writes := make(chan error, 2)
+	for _, p := range []string{"/a", "/b"} {
+		f, err := c.OpenFile(p, os.O_WRONLY)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		go func() {
+			_, err := f.Write([]byte("data"))
+			writes <- err
+		}()
+	}
+	<-bothHeld
+
+	barrier := make(chan error, 1)
+	go func() { barrier <- c.Barrier() }()
+	select {
+	case err := <-barrier:
+		t.Fatalf("Barrier returned %v with both writes unacknowledged", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the stat releases the acks, and is itself sent after the barrier
+	if _, err := c.Stat("/release"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-barrier; err != nil {
+		t.Errorf("Barrier: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-writes; err != nil {
+			t.Errorf("Write: %v", err)
+		}
+	}
+
+	if err := c.Barrier(); err != nil {
+		t.Errorf("Barrier with nothing in flight: %v", err)
+	}
+	c.Close()
+	if err := c.Barrier(); err != ErrClientClosed {
+		t.Errorf("Barrier after Close: got %v, want ErrClientClosed", err)
+	}
+}
+
+func TestClientBarrierLargeWrite(t *testing.T) {
+	const chunks = 4
+	var held encoding.BinaryMarshaler
+	firstSent := make(chan struct{})
+	var writes int32
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, rest := unmarshalUint32(data)
+		switch typ {
+		case sshFxpOpen:
+			p, _ := unmarshalString(rest)
+			return sshFxpHandlePacket{ID: id, Handle: p}
+		case sshFxpWrite:
+			if atomic.AddInt32(&writes, 1) == 1 {
+				// hold the first ack back until the next stat, so that
+				// the rest of the write is still to be sent
+				held = fakeStatus(id, sshFxOk)
+				close(firstSent)
+				return nil
+			}
+			// give Barrier time to return early
+			time.Sleep(10 * time.Millisecond)
+			return fakeStatus(id, sshFxOk)
+		case sshFxpStat:
+			return fakeReplies{held, sshFxpStatResponse{ID: id, info: &fileInfo{name: "f"}}}
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	}, MaxPacket(1024))
+	defer c.Close()
+
+	f, err := c.OpenFile("/a", os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	go f.Write(make([]byte, chunks*1024))
+	<-firstSent
+
+	barrier := make(chan error, 1)
+	go func() { barrier <- c.Barrier() }()
+	select {
+	case err := <-barrier:
+		t.Fatalf("Barrier returned %v with the write unacknowledged", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := c.Stat("/release"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-barrier; err != nil {
+		t.Errorf("Barrier: %v", err)
+	}
+	if n := atomic.LoadInt32(&writes); n != chunks {
+		t.Errorf("Barrier returned after %d of the %d writes of a Write running when it was called", n, chunks)
+	}
+}
+
+func TestClientBarrierSync(t *testing.T) {
+	var synced []string
+	failSync := "/b"
+	c := newFakeClientExt(t, []sshExtensionPair{{"fsync@openssh.com", "1"}}, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, rest := unmarshalUint32(data)
+		switch typ {
+		case sshFxpOpen:
+			p, _ := unmarshalString(rest)
+			return sshFxpHandlePacket{ID: id, Handle: p}
+		case sshFxpWrite, sshFxpClose:
+			return fakeStatus(id, sshFxOk)
+		case sshFxpExtended:
+			_, rest = unmarshalString(rest)
+			handle, _ := unmarshalString(rest)
+			synced = append(synced, handle)
+			if handle == failSync {
+				return fakeStatus(id, sshFxFailure)
+			}
+			return fakeStatus(id, sshFxOk)
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	})
+	defer c.Close()
+
+	files := map[string]*File{}
+	for _, p := range []string{"/a", "/b", "/unwritten", "/closed"} {
+		f, err := c.OpenFile(p, os.O_WRONLY)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files[p] = f
+	}
+	for _, p := range []string{"/a", "/b", "/closed"} {
+		if _, err := files[p].Write([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files["/closed"].Close()
+
+	err := c.BarrierSync()
+	if errs, ok := err.(MultiError); !ok || len(errs) != 1 || !isStatusCode(errs[0].(*os.PathError).Err, sshFxFailure) {
+		t.Errorf("BarrierSync: got %v, want the failure to flush /b", err)
+	}
+	sort.Strings(synced)
+	if want := []string{"/a", "/b"}; !reflect.DeepEqual(synced, want) {
+		t.Errorf("flushed %v, want %v", synced, want)
+	}
+
+	// only the file which failed is flushed again
+	synced, failSync = nil, ""
+	if err := c.BarrierSync(); err != nil {
+		t.Errorf("BarrierSync: %v", err)
+	}
+	if want := []string{"/b"}; !reflect.DeepEqual(synced, want) {
+		t.Errorf("flushed %v the second time, want %v", synced, want)
+	}
+
+	plain := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, _ := unmarshalUint32(data)
+		return fakeStatus(id, sshFxOPUnsupported)
+	})
+	defer plain.Close()
+	if err := plain.BarrierSync(); !isStatusCode(err, sshFxOPUnsupported) {
+		t.Errorf("BarrierSync without fsync@openssh.com: got %v, want unsupported", err)
+	}
+}
+
+func TestClientReadLinkMany(t *testing.T) {
+	links := map[string]string{
+		"/usr/lib/libc.so":    "libc.so.6",
+		"/usr/lib/libm.so":    "libm.so.6",
+		"/usr/bin/python":     "python3",
+		"/usr/share/man/link": "../doc",
+	}
+	paths := []string{"/usr/lib/libc.so", "/usr/bin/python", "/usr/bin/ls", "/usr/lib/libm.so", "/missing", "/usr/share/man/link"}
+	var held fakeReplies
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		if typ != sshFxpReadlink {
+			return nil
+		}
+		id, rest := unmarshalUint32(data)
+		p, _ := unmarshalString(rest)
+		var reply encoding.BinaryMarshaler
+		switch target, ok := links[p]; {
+		case ok:
+			reply = sshFxpNamePacket{ID: id, NameAttrs: []sshFxpNameAttr{{Name: target, LongName: target, Attrs: emptyFileStat}}}
+		case p == "/usr/bin/ls":
+			reply = fakeStatus(id, sshFxFailure) // not a symlink
+		default:
+			reply = fakeStatus(id, sshFxNoSuchFile)
+		}
+		// answer only once every request is in, last first, so that the
+		// test only passes if they are all outstanding at once
+		held = append(fakeReplies{reply}, held...)
+		if len(held) < len(paths) {
+			return nil
+		}
+		return held
+	}, MaxConcurrentRequestsPerFile(len(paths)))
+	defer c.Close()
+
+	targets, errs := c.ReadLinkMany(paths)
+	if len(targets) != len(paths) || len(errs) != len(paths) {
+		t.Fatalf("got %d targets and %d errors for %d paths", len(targets), len(errs), len(paths))
+	}
+	for i, p := range paths {
+		switch target, ok := links[p]; {
+		case ok:
+			if errs[i] != nil || targets[i] != target {
+				t.Errorf("%s: got %q, %v; want %q", p, targets[i], errs[i], target)
+			}
+		case p == "/usr/bin/ls":
+			if !isStatusCode(errs[i], sshFxFailure) {
+				t.Errorf("%s: got %q, %v; want a failure status", p, targets[i], errs[i])
+			}
+		default:
+			if !os.IsNotExist(errs[i]) {
+				t.Errorf("%s: got %q, %v; want not exist", p, targets[i], errs[i])
+			}
+		}
+	}
+}
+
+func TestClientCopyAttrsPartial(t *testing.T) {
+	// an ATTRS reply with only the given flags' fields
+	attrsReply := func(id, flags uint32, fields ...uint32) rawReply {
+		b := marshalUint32([]byte{sshFxpAttrs}, id)
+		b = marshalUint32(b, flags)
+		for _, f := range fields {
+			b = marshalUint32(b, f)
+		}
+		return rawReply(b)
+	}
+	var setFlags uint32
+	var setAttrs []byte
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, data := unmarshalUint32(data)
+		name, data := unmarshalString(data)
+		switch {
+		case typ == sshFxpLstat && name == "/src":
+			return attrsReply(id, sshFileXferAttrPermissions|sshFileXferAttrACmodTime, 0100640, 1000, 2000)
+		case typ == sshFxpLstat && name == "/link":
+			return attrsReply(id, sshFileXferAttrPermissions, 0120777)
+		case typ == sshFxpSetstat:
+			setFlags, setAttrs = unmarshalUint32(data)
+			return fakeStatus(id, sshFxOk)
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	})
+	defer c.Close()
+
+	if err := c.CopyAttrs("/src", "/dst"); err != nil {
+		t.Fatal(err)
+	}
+	if want := uint32(sshFileXferAttrPermissions | sshFileXferAttrACmodTime); setFlags != want {
+		t.Errorf("SETSTAT flags are %#x, want %#x", setFlags, want)
+	}
+	want := marshalUint32(marshalUint32(marshalUint32(nil, 0640), 1000), 2000)
+	if !bytes.Equal(setAttrs, want) {
+		t.Errorf("SETSTAT attributes are %v, want %v", setAttrs, want)
+	}
+
+	setFlags = 0
+	if err := c.CopyAttrs("/link", "/dst"); err == nil {
+		t.Error("CopyAttrs from a symbolic link succeeded")
+	}
+	if setFlags != 0 {
+		t.Error("CopyAttrs from a symbolic link sent a SETSTAT")
+	}
+}
+
+func TestClientMaxPathLength(t *testing.T) {
+	var requests int
+	handler := func(typ byte, data []byte) encoding.BinaryMarshaler {
+		requests++
+		id, _ := unmarshalUint32(data)
+		if typ == sshFxpLstat || typ == sshFxpStat {
+			return sshFxpStatResponse{ID: id, info: &fileInfo{name: "f"}}
+		}
+		return fakeStatus(id, sshFxOk)
+	}
+
+	c := newFakeClient(t, handler)
+	long := "/" + strings.Repeat("d/", defaultMaxPathLength/2)
+	if _, err := c.Stat(long); err != ErrNameTooLong {
+		t.Errorf("Stat of a %d byte path: got %v, want ErrNameTooLong", len(long), err)
+	}
+	if _, err := c.Stat("/" + strings.Repeat("n", 1000)); err != nil {
+		t.Errorf("Stat of a long name with the default limits: %v", err)
+	}
+	c.Close()
+	if requests != 1 {
+		t.Errorf("server got %d requests, want only the one within the limits", requests)
+	}
+
+	requests = 0
+	c = newFakeClient(t, handler, MaxPathLength(64, 8))
+	defer c.Close()
+	if err := c.Rename("/a/short", "/a/"+strings.Repeat("n", 9)); err != ErrNameTooLong {
+		t.Errorf("Rename to a 9 byte name: got %v, want ErrNameTooLong", err)
+	}
+	if err := c.Mkdir("/" + strings.Repeat("a/", 40)); err != ErrNameTooLong {
+		t.Errorf("Mkdir of an 81 byte path: got %v, want ErrNameTooLong", err)
+	}
+	if requests != 0 {
+		t.Errorf("server got %d requests for paths over the limits", requests)
+	}
+	infos, errs := c.StatMany([]string{"/ok", "/" + strings.Repeat("n", 9), "/fine"})
+	if errs[0] != nil || errs[2] != nil || infos[0] == nil || infos[2] == nil {
+		t.Errorf("StatMany of paths within the limits: got %v", errs)
+	}
+	if errs[1] != ErrNameTooLong {
+		t.Errorf("StatMany of a 9 byte name: got %v, want ErrNameTooLong", errs[1])
+	}
+}
+
+func TestFileWriteAt(t *testing.T) {
+	content := []byte("Hello ......")
+	c := newFakeClient(t, memFileServer(&content))
+	defer c.Close()
+
+	f, err := c.OpenFile("/f", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if n, err := f.WriteAt([]byte("world!"), 6); n != 6 || err != nil {
+		t.Fatalf("WriteAt: got %d, %v", n, err)
+	}
+	if off, err := f.Seek(0, io.SeekCurrent); off != 0 || err != nil {
+		t.Errorf("WriteAt moved the file offset to %d, %v", off, err)
+	}
+	got := make([]byte, len(content))
+	if n, err := f.ReadAt(got, 0); n != len(got) || (err != nil && err != io.EOF) {
+		t.Fatalf("ReadAt: got %d, %v", n, err)
+	}
+	if string(got) != "Hello world!" {
+		t.Errorf("the file holds %q, want %q", got, "Hello world!")
+	}
+	if _, err := f.WriteAt([]byte("x"), -1); err == nil {
+		t.Error("WriteAt at a negative offset succeeded")
+	}
+}
+
+func TestFileSeek(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	c := newFakeClient(t, memFileServer(&content))
+	defer c.Close()
+
+	f, err := c.Open("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, tt := range []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{10, io.SeekStart, 10},
+		{-5, io.SeekCurrent, 5},
+		{-10, io.SeekEnd, 10},
+	} {
+		off, err := f.Seek(tt.offset, tt.whence)
+		if off != tt.want || err != nil {
+			t.Fatalf("Seek(%d, %d): got %d, %v; want %d", tt.offset, tt.whence, off, err, tt.want)
+		}
+	}
+	tail, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(tail) != "abcdefghij" {
+		t.Errorf("read %q after seeking to the middle, want %q", tail, "abcdefghij")
+	}
+
+	if _, err := f.Seek(-1, io.SeekStart); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("Seek before the start: got %v, want EINVAL", err)
+	}
+	if off, _ := f.Seek(0, io.SeekCurrent); off != int64(len(content)) {
+		t.Errorf("a failed Seek moved the offset to %d", off)
+	}
+}
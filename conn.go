@@ -4,6 +4,7 @@ import (
 	"encoding"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -35,6 +36,17 @@ func (c *conn) sendPacket(m encoding.BinaryMarshaler) error {
 	return sendPacket(c, m)
 }
 
+// flush waits for any packet that is being written to be completely handed
+// to the writer, and then flushes the writer if it supports it.
+func (c *conn) flush() error {
+	c.Lock()
+	defer c.Unlock()
+	if f, ok := c.WriteCloser.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
 func (c *conn) Close() error {
 	c.Lock()
 	defer c.Unlock()
@@ -44,8 +56,24 @@ func (c *conn) Close() error {
 type clientConn struct {
 	conn
 	wg         sync.WaitGroup
-	sync.Mutex                          // protects inflight
+	sync.Mutex                          // protects inflight, owners, cancelled, maxID, userClosed, idleTimer and answered
 	inflight   map[uint32]chan<- result // outstanding requests
+	maxID      uint32                   // highest request id dispatched
+	owners     map[uint32]interface{}   // owners of outstanding requests, if any
+	cancelled  map[uint32]struct{}      // cancelled requests yet to be answered
+	userClosed bool                     // Close has been called
+	answered   *sync.Cond               // signalled as requests leave inflight, once waitAnswered is used
+
+	idleTimeout time.Duration // set by IdleTimeout, 0 if unset
+	idleTimer   *time.Timer   // closes the session after idleTimeout
+
+	// closeOrphan, if set, is called with the handle a cancelled request
+	// was answered with, so that it is not left open on the server
+	closeOrphan func(handle string)
+
+	// checkRequest, if set, vets each request before it is sent; the
+	// request fails with its error instead
+	checkRequest func(p idmarshaler) error
 
 	closed chan struct{}
 	err    error
@@ -59,12 +87,52 @@ func (c *clientConn) Wait() error {
 	return c.err
 }
 
-// Close closes the SFTP session.
+// Close closes the SFTP session. Requests still waiting for a reply, and
+// any made afterwards, fail with ErrClientClosed.
 func (c *clientConn) Close() error {
+	c.Lock()
+	c.userClosed = true
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	c.Unlock()
 	defer c.wg.Wait()
 	return c.conn.Close()
 }
 
+// startIdleTimer starts the timer closing the session once it has been idle
+// for idleTimeout, if that is set.
+func (c *clientConn) startIdleTimer() {
+	if c.idleTimeout <= 0 {
+		return
+	}
+	c.Lock()
+	c.idleTimer = time.AfterFunc(c.idleTimeout, c.idle)
+	c.Unlock()
+}
+
+// idle is called when no request has been sent or answered for idleTimeout.
+// A request which is taking that long to be answered is not idleness.
+func (c *clientConn) idle() {
+	c.Lock()
+	busy := len(c.inflight) > 0
+	if busy {
+		c.idleTimer.Reset(c.idleTimeout)
+	}
+	c.Unlock()
+	if !busy {
+		c.Close()
+	}
+}
+
+// resetIdleTimer restarts the idle timer, if any, after some activity. It
+// must be called with the lock held.
+func (c *clientConn) resetIdleTimer() {
+	if c.idleTimer != nil && !c.userClosed {
+		c.idleTimer.Reset(c.idleTimeout)
+	}
+}
+
 func (c *clientConn) loop() {
 	defer c.wg.Done()
 	err := c.recv()
@@ -73,22 +141,65 @@ func (c *clientConn) loop() {
 	}
 }
 
+// maxUndecodablePackets is the number of consecutive packets without a
+// request id after which recv gives up on the connection.
+const maxUndecodablePackets = 3
+
 // recv continuously reads from the server and forwards responses to the
 // appropriate channel.
 func (c *clientConn) recv() error {
 	defer func() {
 		c.conn.Close()
 	}()
+	var undecodable int
+	answered := false // any reply has come since the VERSION
 	for {
 		typ, data, err := c.recvPacket(0)
-		if err != nil {
+		if err == nil && len(data) < 4 {
+			err = errShortPacket
+		}
+		if err == errShortPacket {
+			// the packet carries no request id, so cannot be handed to
+			// anyone; a few in a row mean the stream has lost its framing
+			undecodable++
+			if undecodable >= maxUndecodablePackets {
+				return ErrStreamDesynchronized
+			}
+			continue
+		}
+		if err == errLongPacket {
 			return err
 		}
+		if err != nil {
+			return &TransportError{Op: "receive", Err: err, Early: !answered && err == io.EOF}
+		}
+		undecodable = 0
+		answered = true
 		sid, _ := unmarshalUint32(data)
 		c.Lock()
 		ch, ok := c.inflight[sid]
 		delete(c.inflight, sid)
+		delete(c.owners, sid)
+		_, cancelled := c.cancelled[sid]
+		delete(c.cancelled, sid)
+		c.signalAnswered()
+		c.resetIdleTimer()
+		dispatched := sid != 0 && sid <= c.maxID
 		c.Unlock()
+		if cancelled {
+			// the waiter has already been told the request was cancelled
+			if typ == sshFxpHandle && c.closeOrphan != nil {
+				if handle, _, err := unmarshalStringSafe(data[4:]); err == nil {
+					c.closeOrphan(handle)
+				}
+			}
+			continue
+		}
+		if !ok && dispatched {
+			// ids are handed out in increasing order, so this one was
+			// sent and has been answered already
+			return ErrDuplicateResponse
+		}
 		if !ok {
 			// This is an unexpected occurrence. Send the error
 			// back to all listeners so that they terminate
@@ -118,18 +229,156 @@ func (c *clientConn) sendPacket(p idmarshaler) (byte, []byte, error) {
 	return s.typ, s.data, s.err
 }
 
+// errRequestCancelled is returned by sendRequestWithCancel when done is
+// closed before the reply arrives.
+var errRequestCancelled = errors.New("sftp: request cancelled")
+
+// sendRequestWithCancel is like sendPacket, but stops waiting for the reply
+// once done is closed, returning errRequestCancelled. The request is then
+// forgotten: its reply is dropped when it comes, and any handle in it is
+// passed to closeOrphan. A reply which has already arrived is returned.
+func (c *clientConn) sendRequestWithCancel(p idmarshaler, done <-chan struct{}) (byte, []byte, error) {
+	ch := make(chan result, 2)
+	c.dispatchRequest(ch, p)
+	select {
+	case s := <-ch:
+		return s.typ, s.data, s.err
+	case <-done:
+	}
+	c.Lock()
+	_, waiting := c.inflight[p.id()]
+	if waiting {
+		delete(c.inflight, p.id())
+		delete(c.owners, p.id())
+		c.signalAnswered()
+		if c.cancelled == nil {
+			c.cancelled = make(map[uint32]struct{})
+		}
+		c.cancelled[p.id()] = struct{}{}
+	}
+	c.Unlock()
+	if !waiting {
+		// the reply, or an error, is on its way to ch
+		s := <-ch
+		return s.typ, s.data, s.err
+	}
+	return 0, nil, errRequestCancelled
+}
+
 func (c *clientConn) dispatchRequest(ch chan<- result, p idmarshaler) {
+	c.dispatchOwnedRequest(nil, ch, p)
+}
+
+// dispatchOwnedRequest is like dispatchRequest, but records owner as the
+// owner of the request so that it can be cancelled with cancelOwned.
+func (c *clientConn) dispatchOwnedRequest(owner interface{}, ch chan<- result, p idmarshaler) {
+	if c.checkRequest != nil {
+		if err := c.checkRequest(p); err != nil {
+			ch <- result{err: err}
+			return
+		}
+	}
 	c.Lock()
+	if c.userClosed {
+		c.Unlock()
+		ch <- result{err: ErrClientClosed}
+		return
+	}
+	select {
+	case <-c.closed:
+		// the connection has shut down and no reply will ever come
+		c.Unlock()
+		ch <- result{err: c.err}
+		return
+	default:
+	}
 	c.inflight[p.id()] = ch
+	if p.id() > c.maxID {
+		c.maxID = p.id()
+	}
+	c.resetIdleTimer()
+	if owner != nil {
+		if c.owners == nil {
+			c.owners = make(map[uint32]interface{})
+		}
+		c.owners[p.id()] = owner
+	}
 	c.Unlock()
 	if err := c.conn.sendPacket(p); err != nil {
 		c.Lock()
 		delete(c.inflight, p.id())
+		delete(c.owners, p.id())
+		c.signalAnswered()
 		c.Unlock()
 		ch <- result{err: err}
 	}
 }
 
+// cancelOwned fails all outstanding requests dispatched for owner with err,
+// without waiting for the server. Their replies are dropped when they come.
+func (c *clientConn) cancelOwned(owner interface{}, err error) {
+	var listeners []chan<- result
+	c.Lock()
+	for id, o := range c.owners {
+		if o != owner {
+			continue
+		}
+		listeners = append(listeners, c.inflight[id])
+		delete(c.inflight, id)
+		delete(c.owners, id)
+		if c.cancelled == nil {
+			c.cancelled = make(map[uint32]struct{})
+		}
+		c.cancelled[id] = struct{}{}
+	}
+	c.signalAnswered()
+	c.Unlock()
+	for _, ch := range listeners {
+		ch <- result{err: err}
+	}
+}
+
+// waitAnswered blocks until every request dispatched before it was called
+// has been answered, failed or cancelled. It returns the error which shut
+// the connection down if that happens first.
+func (c *clientConn) waitAnswered() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.answered == nil {
+		c.answered = sync.NewCond(&c.Mutex)
+	}
+	mark := c.maxID
+	for {
+		select {
+		case <-c.closed:
+			return c.err
+		default:
+		}
+		if c.userClosed {
+			return ErrClientClosed
+		}
+		pending := false
+		for id := range c.inflight {
+			if id <= mark {
+				pending = true
+				break
+			}
+		}
+		if !pending {
+			return nil
+		}
+		c.answered.Wait()
+	}
+}
+
+// signalAnswered wakes any waitAnswered. It must be called with the lock
+// held.
+func (c *clientConn) signalAnswered() {
+	if c.answered != nil {
+		c.answered.Broadcast()
+	}
+}
+
 // broadcastErr sends an error to all goroutines waiting for a response.
 func (c *clientConn) broadcastErr(err error) {
 	c.Lock()
@@ -137,12 +386,19 @@ func (c *clientConn) broadcastErr(err error) {
 	for _, ch := range c.inflight {
 		listeners = append(listeners, ch)
 	}
+	if c.userClosed {
+		// whatever error the shutdown caused, it was asked for
+		err = ErrClientClosed
+	}
+	// setting these under the lock ensures that no request can be
+	// dispatched after the listeners are collected and still be waiting
+	c.err = err
+	close(c.closed)
+	c.signalAnswered()
 	c.Unlock()
 	for _, ch := range listeners {
 		ch <- result{err: err}
 	}
-	c.err = err
-	close(c.closed)
 }
 
 type serverConn struct {
@@ -0,0 +1,177 @@
+package sftp
+
+import (
+	"io"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// CopyFileRange copies length bytes from src, starting at srcOff, to dst,
+// starting at dstOff, and returns the number of bytes copied. As SFTP version
+// 3 has no copy request, the data passes through the client: maxPacket sized
+// reads from src are pipelined, and each chunk is written to dst as soon as it
+// arrives, so that reading and writing overlap. Up to the per-file
+// concurrency limit of requests are outstanding at a time.
+//
+// Both files must have been opened through c. Their offsets are left as they
+// are, as with ReadAt. If src ends before length bytes, the bytes up to its
+// end are copied and no error is returned. On failure, the error for the
+// lowest offset is returned, together with the length of the run of bytes
+// from the start of the range which are known to have been written.
+func (c *Client) CopyFileRange(dst, src *File, dstOff, srcOff, length int64) (n int64, err error) {
+	defer c.logOp("copy", src.path, &err)
+	if dst.c != c || src.c != c {
+		return 0, errors.New("sftp: CopyFileRange on a file of another client")
+	}
+	if dstOff < 0 || srcOff < 0 {
+		return 0, errors.New("sftp: CopyFileRange with a negative offset")
+	}
+	if length <= 0 {
+		return 0, nil
+	}
+	defer c.writeCalls.end(c.writeCalls.start())
+	c.written.add(dst)
+
+	// spans are relative to the start of the range
+	type span struct{ off, len uint64 }
+	// maxConcurrentRequests buffer to deal with broadcastErr() floods
+	ch := make(chan result, c.maxConcurrentRequests+1)
+	reads := make(map[uint32]span)
+	writes := make(map[uint32]span)
+	acked := make(map[uint64]uint64)
+	var retries []span // the rest of each short read
+	next, end := uint64(0), uint64(length)
+	inFlight := 0
+
+	var firstErr, connErr error
+	var firstErrOff uint64
+	fail := func(off uint64, err error) {
+		if firstErr == nil || off < firstErrOff {
+			firstErr, firstErrOff = err, off
+		}
+	}
+
+	for {
+		for inFlight < c.maxConcurrentRequests && firstErr == nil && connErr == nil {
+			var s span
+			switch {
+			case len(retries) > 0:
+				s, retries = retries[0], retries[1:]
+			case next < end:
+				s = span{next, uint64(min(c.readSize(), int(end-next)))}
+				next += s.len
+			}
+			if s.len == 0 {
+				break
+			}
+			id := c.nextID()
+			reads[id] = s
+			c.dispatchOwnedRequest(src, ch, sshFxpReadPacket{
+				ID:     id,
+				Handle: src.handle,
+				Offset: uint64(srcOff) + s.off,
+				Len:    uint32(s.len),
+			})
+			atomic.AddUint64(&src.stats.ReadRequests, 1)
+			inFlight++
+		}
+
+		if inFlight == 0 {
+			break
+		}
+		res := <-ch
+		inFlight--
+		if res.err != nil {
+			if connErr == nil {
+				connErr = res.err
+			}
+			continue
+		}
+		id, data := unmarshalUint32(res.data)
+		if s, ok := writes[id]; ok {
+			delete(writes, id)
+			switch res.typ {
+			case sshFxpStatus:
+				if err := normaliseError(unmarshalStatus(id, res.data)); err != nil {
+					fail(s.off, err)
+				} else {
+					acked[s.off] = s.len
+				}
+			default:
+				fail(s.off, unimplementedPacketErr(res.typ))
+			}
+			continue
+		}
+		s, ok := reads[id]
+		if !ok {
+			if connErr == nil {
+				connErr = errors.Errorf("sid: %v not found", id)
+			}
+			continue
+		}
+		delete(reads, id)
+		switch res.typ {
+		case sshFxpStatus:
+			err := normaliseError(unmarshalStatus(id, res.data))
+			if err == io.EOF {
+				// src ends here; nothing past it is to be copied
+				if s.off < end {
+					end = s.off
+				}
+				break
+			}
+			fail(s.off, err)
+		case sshFxpData:
+			l, data := unmarshalUint32(data)
+			if uint64(l) > s.len {
+				l = uint32(s.len)
+			}
+			if l == 0 {
+				// no data and no EOF; treat it as the end rather than
+				// asking again forever
+				if s.off < end {
+					end = s.off
+				}
+				break
+			}
+			atomic.AddUint64(&src.stats.BytesRead, uint64(l))
+			if uint64(l) < s.len {
+				atomic.AddUint64(&src.stats.Retries, 1)
+				retries = append(retries, span{s.off + uint64(l), s.len - uint64(l)})
+			}
+			if s.off >= end {
+				break
+			}
+			wid := c.nextID()
+			writes[wid] = span{s.off, uint64(l)}
+			c.dispatchOwnedRequest(dst, ch, sshFxpWritePacket{
+				ID:     wid,
+				Handle: dst.handle,
+				Offset: uint64(dstOff) + s.off,
+				Length: l,
+				Data:   data[:l],
+			})
+			dst.countWrite(int(l))
+			inFlight++
+		default:
+			fail(s.off, unimplementedPacketErr(res.typ))
+		}
+	}
+
+	var copied uint64
+	for copied < end {
+		l, ok := acked[copied]
+		if !ok {
+			break
+		}
+		copied += l
+	}
+	if copied > end {
+		copied = end
+	}
+	if firstErr != nil {
+		return int64(copied), firstErr
+	}
+	return int64(copied), connErr
+}
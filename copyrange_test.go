@@ -0,0 +1,86 @@
+package sftp
+
+import (
+	"bytes"
+	"encoding"
+	"os"
+	"testing"
+)
+
+// memFilesServer is a fake server holding the files in files, which it
+// hands out the path of as their handle.
+func memFilesServer(files map[string]*[]byte, maxRead uint32) func(typ byte, data []byte) encoding.BinaryMarshaler {
+	return func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, rest := unmarshalUint32(data)
+		name, rest := unmarshalString(rest)
+		content, ok := files[name]
+		if !ok {
+			return fakeStatus(id, sshFxNoSuchFile)
+		}
+		switch typ {
+		case sshFxpOpen:
+			return sshFxpHandlePacket{ID: id, Handle: name}
+		case sshFxpRead:
+			// serve short reads, to make the client ask again
+			offset, rest := unmarshalUint64(rest)
+			if length, _ := unmarshalUint32(rest); length > maxRead {
+				data = marshal(nil, struct {
+					ID     uint32
+					Handle string
+					Offset uint64
+					Len    uint32
+				}{id, name, offset, maxRead})
+			}
+		}
+		return memFileServer(content)(typ, data)
+	}
+}
+
+func TestClientCopyFileRange(t *testing.T) {
+	src := make([]byte, 10000)
+	for i := range src {
+		src[i] = byte(i * 7)
+	}
+	dst := bytes.Repeat([]byte{'x'}, 1000)
+	files := map[string]*[]byte{"/src": &src, "/dst": &dst}
+	c := newFakeClient(t, memFilesServer(files, 700), MaxPacket(1024))
+	defer c.Close()
+
+	sf, err := c.Open("/src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sf.Close()
+	df, err := c.OpenFile("/dst", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer df.Close()
+
+	n, err := c.CopyFileRange(df, sf, 300, 100, 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5000 {
+		t.Errorf("copied %d bytes, want 5000", n)
+	}
+	want := append(bytes.Repeat([]byte{'x'}, 300), src[100:5100]...)
+	if !bytes.Equal(dst, want) {
+		t.Errorf("destination differs from the copied range")
+	}
+	if st := sf.Stats(); st.Retries == 0 {
+		t.Errorf("short reads were not asked for again: %+v", st)
+	}
+
+	// a range running past the end of src stops there
+	n, err = c.CopyFileRange(df, sf, 0, 9000, 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1000 {
+		t.Errorf("copied %d bytes past the end, want 1000", n)
+	}
+	if !bytes.Equal(dst[:1000], src[9000:]) {
+		t.Errorf("destination differs from the tail of the source")
+	}
+}
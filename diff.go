@@ -0,0 +1,210 @@
+package sftp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DiffKind says how a path differs between a remote and a local tree.
+type DiffKind int
+
+// The kinds of difference reported by Client.Diff and Client.DiffContent.
+const (
+	RemoteOnly      DiffKind = iota + 1 // the path exists only in the remote tree
+	LocalOnly                           // the path exists only in the local tree
+	TypeMismatch                        // one is a directory, link or file, the other is not the same
+	SizeMismatch                        // both are regular files, of different sizes
+	MtimeMismatch                       // both are regular files of the same size, modified at different times
+	ContentMismatch                     // both are regular files of the same size and time, with different hashes
+)
+
+func (k DiffKind) String() string {
+	switch k {
+	case RemoteOnly:
+		return "remote only"
+	case LocalOnly:
+		return "local only"
+	case TypeMismatch:
+		return "type mismatch"
+	case SizeMismatch:
+		return "size mismatch"
+	case MtimeMismatch:
+		return "mtime mismatch"
+	case ContentMismatch:
+		return "content mismatch"
+	default:
+		return "unknown"
+	}
+}
+
+// DiffEntry is a difference between a remote and a local tree.
+type DiffEntry struct {
+	Path   string // relative to the roots, slash separated
+	Kind   DiffKind
+	Remote os.FileInfo // nil for LocalOnly
+	Local  os.FileInfo // nil for RemoteOnly
+}
+
+// Diff compares the remote tree rooted at remoteRoot with the local tree
+// rooted at localRoot, and returns their differences sorted by path, for a
+// sync tool to act upon. The remote tree is read with StatTree, so without
+// a stat per file. Symbolic links are compared as links, and not followed.
+//
+// Regular files are compared by size and then by modification time, to the
+// second as that is all the protocol carries, but not by content: files
+// which were changed without changing either are not reported, unless
+// DiffContent is used instead. Directories are only compared for existence.
+// Every path missing on one side is reported, including those inside a
+// directory which is itself missing.
+func (c *Client) Diff(remoteRoot, localRoot string) ([]DiffEntry, error) {
+	return c.diff(remoteRoot, localRoot, "")
+}
+
+// DiffContent is like Diff, but also compares the regular files which agree
+// in size and modification time by their algo hash, such as "sha256" or
+// "md5", computed by the server with the check-file extension and locally
+// by reading the file. Those whose hashes differ are reported as
+// ContentMismatch. A *StatusError with code SSH_FX_OP_UNSUPPORTED is
+// returned if the server does not support the extension.
+func (c *Client) DiffContent(remoteRoot, localRoot, algo string) ([]DiffEntry, error) {
+	if _, ok := c.HasExtension("check-file"); !ok {
+		return nil, &StatusError{Code: sshFxOPUnsupported, msg: "check-file not supported by the server"}
+	}
+	if _, ok := diffHashes[algo]; !ok {
+		return nil, errors.Errorf("sftp: DiffContent with unknown hash algorithm %q", algo)
+	}
+	return c.diff(remoteRoot, localRoot, algo)
+}
+
+// diffHashes are the algorithms of the check-file extension which
+// DiffContent can compute locally.
+var diffHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha224": sha256.New224,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// diff implements Diff, and DiffContent if algo is not empty.
+func (c *Client) diff(remoteRoot, localRoot, algo string) ([]DiffEntry, error) {
+	remoteTree, err := c.StatTree(remoteRoot)
+	if err != nil {
+		return nil, err
+	}
+	// the paths of the walk are joined to remoteRoot, so drop it cleaned,
+	// bearing in mind that joining to "." adds nothing
+	root := path.Clean(remoteRoot)
+	prefix := root + "/"
+	switch root {
+	case ".":
+		prefix = ""
+	case "/":
+		prefix = "/"
+	}
+	remote := make(map[string]os.FileInfo, len(remoteTree))
+	for p, fi := range remoteTree {
+		if p = path.Clean(p); p != root {
+			remote[strings.TrimPrefix(p, prefix)] = fi
+		}
+	}
+
+	local := make(map[string]os.FileInfo)
+	err = filepath.Walk(localRoot, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localRoot, p)
+		if err != nil {
+			return err
+		}
+		if rel != "." {
+			local[filepath.ToSlash(rel)] = fi
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []DiffEntry
+	for p, rfi := range remote {
+		lfi, ok := local[p]
+		if !ok {
+			diffs = append(diffs, DiffEntry{Path: p, Kind: RemoteOnly, Remote: rfi})
+			continue
+		}
+		kind := compareFileInfo(rfi, lfi)
+		if kind == 0 && algo != "" && rfi.Mode().IsRegular() {
+			same, err := c.sameContent(path.Join(remoteRoot, p), filepath.Join(localRoot, filepath.FromSlash(p)), algo)
+			if err != nil {
+				return nil, err
+			}
+			if !same {
+				kind = ContentMismatch
+			}
+		}
+		if kind != 0 {
+			diffs = append(diffs, DiffEntry{Path: p, Kind: kind, Remote: rfi, Local: lfi})
+		}
+	}
+	for p, lfi := range local {
+		if _, ok := remote[p]; !ok {
+			diffs = append(diffs, DiffEntry{Path: p, Kind: LocalOnly, Local: lfi})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Path < diffs[j].Path
+	})
+	return diffs, nil
+}
+
+// compareFileInfo returns how rfi and lfi, which describe the same path,
+// differ, or 0 if they do not.
+func compareFileInfo(rfi, lfi os.FileInfo) DiffKind {
+	if rfi.Mode()&os.ModeType != lfi.Mode()&os.ModeType {
+		return TypeMismatch
+	}
+	if !rfi.Mode().IsRegular() {
+		return 0
+	}
+	switch {
+	case rfi.Size() != lfi.Size():
+		return SizeMismatch
+	case rfi.ModTime().Unix() != lfi.ModTime().Unix():
+		return MtimeMismatch
+	}
+	return 0
+}
+
+// sameContent reports whether the files remote and local have the same algo
+// hash.
+func (c *Client) sameContent(remote, local, algo string) (bool, error) {
+	rsum, err := c.checkFileName(remote, algo)
+	if err != nil {
+		return false, err
+	}
+	f, err := os.Open(local)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	h := diffHashes[algo]()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, err
+	}
+	return bytes.Equal(rsum, h.Sum(nil)), nil
+}
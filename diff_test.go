@@ -0,0 +1,92 @@
+package sftp
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestClientDiffContent(t *testing.T) {
+	mtime := time.Unix(1234567890, 0)
+	files := map[string]string{
+		"same":    "same",
+		".hidden": "hidden",
+		"changed": "new",
+	}
+	local, err := ioutil.TempDir("", "sftptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(local)
+	for name, contents := range files {
+		if name == "changed" {
+			contents = "old"
+		}
+		p := filepath.Join(local, name)
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the working directory of the server holds the same files, but changed
+	// was rewritten without its size or time changing
+	listed := false
+	c := newFakeClientExt(t, []sshExtensionPair{{"check-file", "1"}}, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, rest := unmarshalUint32(data)
+		switch typ {
+		case sshFxpLstat:
+			return sshFxpStatResponse{ID: id, info: &fileInfo{name: ".", mode: os.ModeDir | 0755}}
+		case sshFxpOpendir:
+			listed = false
+			return sshFxpHandlePacket{ID: id, Handle: "d"}
+		case sshFxpReaddir:
+			if listed {
+				return fakeStatus(id, sshFxEOF)
+			}
+			listed = true
+			var names []sshFxpNameAttr
+			for name, contents := range files {
+				fi := &fileInfo{name: name, size: int64(len(contents)), mode: 0644, mtime: mtime}
+				names = append(names, sshFxpNameAttr{Name: name, LongName: name, Attrs: []interface{}{fi}})
+			}
+			return sshFxpNamePacket{ID: id, NameAttrs: names}
+		case sshFxpClose:
+			return fakeStatus(id, sshFxOk)
+		case sshFxpExtended:
+			_, rest = unmarshalString(rest)
+			p, _ := unmarshalString(rest)
+			sum := sha256.Sum256([]byte(files[p]))
+			return checkFileReply{ID: id, Algo: "sha256", Hash: sum[:]}
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	})
+	defer c.Close()
+
+	diffs, err := c.Diff(".", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("Diff of trees differing only in content: %v", diffs)
+	}
+
+	diffs, err = c.DiffContent(".", local, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range diffs {
+		got = append(got, d.Path+": "+d.Kind.String())
+	}
+	if want := []string{"changed: content mismatch"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffContent: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,133 @@
+package sftp
+
+import "os"
+
+// WriteFileMulti writes data to each of paths, creating the files with
+// permissions mode (before umask) or truncating them, and returns the error
+// for paths[i] at index i, nil if it was written. The opens, writes and
+// closes for all the files are pipelined together, up to the per-file
+// concurrency limit of requests at a time, which on a high latency link is
+// much faster than writing the files one after the other. Files which are
+// already open are written before more are opened, so that few handles are
+// held at once.
+//
+// As with CreateModeChecked, the server may ignore mode; a file which
+// already exists keeps its permissions.
+func (c *Client) WriteFileMulti(paths []string, data []byte, mode os.FileMode) []error {
+	defer c.writeCalls.end(c.writeCalls.start())
+	type target struct {
+		handle  string
+		opened  bool // the server has returned a handle
+		next    int  // offset of the next write to send
+		acked   int  // bytes written
+		pending int  // outstanding writes
+		closing bool
+		done    bool
+		err     error
+	}
+	targets := make([]target, len(paths))
+	type request struct {
+		i    int  // index of the target
+		typ  byte // sshFxpOpen, sshFxpWrite or sshFxpClose
+		size int  // of a write
+	}
+	reqs := make(map[uint32]request)
+	pflags := flags(os.O_WRONLY | os.O_CREATE | os.O_TRUNC)
+	var nextOpen int
+
+	// next returns the next request there is to send, if any
+	next := func() (idmarshaler, bool) {
+		for i := range targets {
+			t := &targets[i]
+			if !t.opened || t.closing {
+				continue
+			}
+			id := c.nextID()
+			switch {
+			case t.err == nil && t.next < len(data):
+				l := min(len(data)-t.next, c.maxPacket)
+				reqs[id] = request{i: i, typ: sshFxpWrite, size: l}
+				pkt := sshFxpWritePacket{
+					ID:     id,
+					Handle: t.handle,
+					Offset: uint64(t.next),
+					Length: uint32(l),
+					Data:   data[t.next : t.next+l],
+				}
+				t.next += l
+				t.pending++
+				return pkt, true
+			case t.pending == 0:
+				reqs[id] = request{i: i, typ: sshFxpClose}
+				t.closing = true
+				return sshFxpClosePacket{
+					ID:     id,
+					Handle: t.handle,
+				}, true
+			}
+		}
+		if nextOpen < len(paths) {
+			c.missingCache.forget(paths[nextOpen])
+			id := c.nextID()
+			reqs[id] = request{i: nextOpen, typ: sshFxpOpen}
+			nextOpen++
+			return sshFxpOpenPacket{
+				ID:     id,
+				Path:   paths[nextOpen-1],
+				Pflags: pflags,
+				Flags:  sshFileXferAttrPermissions,
+				Attrs:  uint32(mode.Perm()),
+			}, true
+		}
+		return nil, false
+	}
+
+	connErr := c.pipeline(next, func(id uint32, typ byte, data []byte, err error) {
+		r := reqs[id]
+		delete(reqs, id)
+		t := &targets[r.i]
+		switch {
+		case err != nil:
+		case typ == sshFxpHandle:
+			if r.typ == sshFxpOpen {
+				_, data = unmarshalUint32(data)
+				t.handle, _ = unmarshalString(data)
+				t.opened = true
+				return
+			}
+			err = unimplementedPacketErr(typ)
+		case typ == sshFxpStatus:
+			err = normaliseError(unmarshalStatus(id, data))
+		default:
+			err = unimplementedPacketErr(typ)
+		}
+		if err != nil && t.err == nil {
+			t.err = err
+		}
+		switch r.typ {
+		case sshFxpOpen:
+			if err == nil {
+				t.err = unimplementedPacketErr(typ)
+			}
+			t.done = true
+		case sshFxpWrite:
+			t.pending--
+			if err == nil {
+				t.acked += r.size
+			}
+		case sshFxpClose:
+			t.done = true
+		}
+	})
+
+	errs := make([]error, len(paths))
+	for i, t := range targets {
+		switch {
+		case t.err != nil:
+			errs[i] = t.err
+		case !t.done || t.acked != len(data):
+			errs[i] = connErr
+		}
+	}
+	return errs
+}
@@ -0,0 +1,82 @@
+package sftp
+
+import (
+	"bytes"
+	"encoding"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestClientWriteFileMulti(t *testing.T) {
+	files := map[string]*[]byte{}
+	modes := map[string]uint32{}
+	serve := memFilesServer(files, 1<<20)
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		if typ == sshFxpOpen {
+			id, rest := unmarshalUint32(data)
+			p, rest := unmarshalString(rest)
+			if strings.HasPrefix(p, "/readonly/") {
+				return fakeStatus(id, sshFxPermissionDenied)
+			}
+			_, rest = unmarshalUint32(rest) // pflags
+			if flags, rest := unmarshalUint32(rest); flags&sshFileXferAttrPermissions != 0 {
+				modes[p], _ = unmarshalUint32(rest)
+			}
+			files[p] = new([]byte)
+		}
+		return serve(typ, data)
+	}, MaxPacket(1024), MaxConcurrentRequestsPerFile(8))
+	defer c.Close()
+
+	var paths []string
+	for i := 0; i < 10; i++ {
+		paths = append(paths, fmt.Sprintf("/etc/app%d.conf", i))
+	}
+	paths = append(paths, "/readonly/app.conf")
+	data := bytes.Repeat([]byte("setting = value\n"), 300)
+
+	errs := c.WriteFileMulti(paths, data, 0640)
+	if len(errs) != len(paths) {
+		t.Fatalf("got %d errors for %d paths", len(errs), len(paths))
+	}
+	for i, p := range paths[:10] {
+		if errs[i] != nil {
+			t.Errorf("%s: %v", p, errs[i])
+			continue
+		}
+		if got := files[p]; got == nil || !bytes.Equal(*got, data) {
+			t.Errorf("%s does not hold the data", p)
+		}
+		if modes[p] != 0640 {
+			t.Errorf("%s was created with mode %#o, want 0640", p, modes[p])
+		}
+	}
+	if err := errs[10]; !isStatusCode(err, sshFxPermissionDenied) {
+		t.Errorf("%s: got %v, want permission denied", paths[10], err)
+	}
+}
+
+func TestClientWriteFileMultiEmpty(t *testing.T) {
+	files := map[string]*[]byte{}
+	serve := memFilesServer(files, 1<<20)
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		if typ == sshFxpOpen {
+			_, rest := unmarshalUint32(data)
+			p, _ := unmarshalString(rest)
+			files[p] = new([]byte)
+		}
+		return serve(typ, data)
+	})
+	defer c.Close()
+
+	for i, err := range c.WriteFileMulti([]string{"/a", "/b"}, nil, os.FileMode(0600)) {
+		if err != nil {
+			t.Errorf("path %d: %v", i, err)
+		}
+	}
+	if len(files) != 2 {
+		t.Errorf("%d files created, want 2", len(files))
+	}
+}
@@ -134,7 +134,7 @@ func sendPacket(w io.Writer, m encoding.BinaryMarshaler) error {
 
 	_, err = w.Write(packet)
 	if err != nil {
-		return errors.Errorf("failed to send packet: %v", err)
+		return &TransportError{Op: "send", Err: err}
 	}
 	return nil
 }
@@ -154,6 +154,10 @@ func recvPacket(r io.Reader, alloc *allocator, orderID uint32) (uint8, []byte, e
 		debug("recv packet %d bytes too long", length)
 		return 0, nil, errLongPacket
 	}
+	if length == 0 {
+		debug("recv packet of 0 bytes")
+		return 0, nil, errShortPacket
+	}
 	if alloc == nil {
 		b = make([]byte, length)
 	}
@@ -521,7 +525,8 @@ type sshFxpOpenPacket struct {
 	ID     uint32
 	Path   string
 	Pflags uint32
-	Flags  uint32 // ignored
+	Flags  uint32      // attribute flags, ignored by the server
+	Attrs  interface{} // the attributes named by Flags, if any
 }
 
 func (p sshFxpOpenPacket) id() uint32 { return p.ID }
@@ -537,6 +542,7 @@ func (p sshFxpOpenPacket) MarshalBinary() ([]byte, error) {
 	b = marshalString(b, p.Path)
 	b = marshalUint32(b, p.Pflags)
 	b = marshalUint32(b, p.Flags)
+	b = marshal(b, p.Attrs)
 	return b, nil
 }
 
@@ -660,6 +666,27 @@ func (p sshFxpPosixRenamePacket) MarshalBinary() ([]byte, error) {
 	return b, nil
 }
 
+type sshFxpFsyncPacket struct {
+	ID     uint32
+	Handle string
+}
+
+func (p sshFxpFsyncPacket) id() uint32 { return p.ID }
+
+func (p sshFxpFsyncPacket) MarshalBinary() ([]byte, error) {
+	const ext = "fsync@openssh.com"
+	l := 1 + 4 + // type(byte) + uint32
+		4 + len(ext) +
+		4 + len(p.Handle)
+
+	b := make([]byte, 0, l)
+	b = append(b, sshFxpExtended)
+	b = marshalUint32(b, p.ID)
+	b = marshalString(b, ext)
+	b = marshalString(b, p.Handle)
+	return b, nil
+}
+
 type sshFxpWritePacket struct {
 	ID     uint32
 	Handle string
@@ -883,6 +910,41 @@ func (p sshFxpStatvfsPacket) MarshalBinary() ([]byte, error) {
 	return b, nil
 }
 
+// sshFxpCheckFileNamePacket asks for the hash of a file, as the check-file
+// extension of draft-ietf-secsh-filexfer-extensions-00 describes. A Length
+// of 0 hashes up to the end of the file and a BlockSize of 0 hashes it as a
+// single block.
+type sshFxpCheckFileNamePacket struct {
+	ID         uint32
+	Path       string
+	Algorithms string // comma separated, in order of preference
+	Offset     uint64
+	Length     uint64
+	BlockSize  uint32
+}
+
+func (p sshFxpCheckFileNamePacket) id() uint32 { return p.ID }
+
+func (p sshFxpCheckFileNamePacket) MarshalBinary() ([]byte, error) {
+	const ext = "check-file-name"
+	l := 1 + 4 + // type(byte) + uint32
+		4 + len(ext) +
+		4 + len(p.Path) +
+		4 + len(p.Algorithms) +
+		8 + 8 + 4 // uint64 + uint64 + uint32
+
+	b := make([]byte, 0, l)
+	b = append(b, sshFxpExtended)
+	b = marshalUint32(b, p.ID)
+	b = marshalString(b, ext)
+	b = marshalString(b, p.Path)
+	b = marshalString(b, p.Algorithms)
+	b = marshalUint64(b, p.Offset)
+	b = marshalUint64(b, p.Length)
+	b = marshalUint32(b, p.BlockSize)
+	return b, nil
+}
+
 // A StatVFS contains statistics about a filesystem.
 type StatVFS struct {
 	ID      uint32
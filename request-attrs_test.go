@@ -51,8 +51,6 @@ func TestRequestAttributes(t *testing.T) {
 
 func TestRequestAttributesEmpty(t *testing.T) {
 	fs, b := getFileStat(sshFileXferAttrAll, nil)
-	assert.Equal(t, &FileStat{
-		Extended: []StatExtended{},
-	}, fs)
+	assert.Equal(t, &FileStat{}, fs)
 	assert.Empty(t, b)
 }
@@ -6,6 +6,7 @@ import (
 	"io"
 	"net"
 	"os"
+	"syscall"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -209,6 +210,45 @@ func TestRequestJustRead(t *testing.T) {
 	checkRequestServerAllocator(t, p)
 }
 
+func TestRequestReadAtEOF(t *testing.T) {
+	p := clientRequestServerPair(t)
+	defer p.Close()
+	_, err := putTestFile(p.cli, "/foo", "hello world")
+	require.NoError(t, err)
+	rf, err := p.cli.Open("/foo")
+	require.NoError(t, err)
+	defer rf.Close()
+	p.cli.maxPacket = 3 // split reads over several packets
+
+	var tests = []struct {
+		desc string
+		off  int64
+		want string
+	}{
+		{desc: "offset at size", off: 11},
+		{desc: "offset beyond size", off: 20},
+		{desc: "span across EOF", off: 5, want: " world"},
+		{desc: "span ending in a short packet", off: 4, want: "o world"},
+	}
+	for _, tt := range tests {
+		b := make([]byte, 10)
+		n, err := rf.ReadAt(b, tt.off)
+		assert.Equal(t, io.EOF, err, tt.desc)
+		assert.Equal(t, len(tt.want), n, tt.desc)
+		assert.Equal(t, tt.want, string(b[:n]), tt.desc)
+	}
+
+	// a read that ends exactly at EOF is complete
+	b := make([]byte, 6)
+	n, err := rf.ReadAt(b, 5)
+	assert.Equal(t, 6, n)
+	assert.Equal(t, " world", string(b))
+	if err != nil {
+		assert.Equal(t, io.EOF, err)
+	}
+	checkRequestServerAllocator(t, p)
+}
+
 func TestRequestOpenFail(t *testing.T) {
 	p := clientRequestServerPair(t)
 	defer p.Close()
@@ -228,6 +268,17 @@ func TestRequestCreate(t *testing.T) {
 	checkRequestServerAllocator(t, p)
 }
 
+func TestRequestCreateMissingParent(t *testing.T) {
+	p := clientRequestServerPair(t)
+	defer p.Close()
+	fh, err := p.cli.Create("/nonexistent/dir/file")
+	assert.Nil(t, fh)
+	require.Error(t, err)
+	assert.Equal(t, "create /nonexistent/dir/file: file does not exist", err.Error())
+	assert.True(t, os.IsNotExist(err))
+	checkRequestServerAllocator(t, p)
+}
+
 func TestRequestMkdir(t *testing.T) {
 	p := clientRequestServerPair(t)
 	defer p.Close()
@@ -284,6 +335,37 @@ func TestRequestRename(t *testing.T) {
 	checkRequestServerAllocator(t, p)
 }
 
+func TestRequestRenameMkdirAll(t *testing.T) {
+	p := clientRequestServerPair(t)
+	defer p.Close()
+	_, err := putTestFile(p.cli, "/foo", "hello")
+	assert.Nil(t, err)
+	err = p.cli.RenameMkdirAll("/foo", "/2020/01/02/foo")
+	require.NoError(t, err)
+	r := p.testHandler()
+	for _, dir := range []string{"/2020", "/2020/01", "/2020/01/02"} {
+		f, err := r.fetch(dir)
+		if assert.NoError(t, err, dir) {
+			assert.True(t, f.IsDir(), dir)
+		}
+	}
+	f, err := r.fetch("/2020/01/02/foo")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(f.content))
+	_, err = r.fetch("/foo")
+	assert.Equal(t, os.ErrNotExist, err)
+
+	// an existing destination is never overwritten
+	_, err = putTestFile(p.cli, "/bar", "goodbye")
+	assert.Nil(t, err)
+	err = p.cli.RenameMkdirAll("/bar", "/2020/01/02/foo")
+	assert.IsType(t, &StatusError{}, err)
+	f, err = r.fetch("/2020/01/02/foo")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(f.content))
+	checkRequestServerAllocator(t, p)
+}
+
 func TestRequestRenameFail(t *testing.T) {
 	p := clientRequestServerPair(t)
 	defer p.Close()
@@ -310,6 +392,46 @@ func TestRequestStat(t *testing.T) {
 	checkRequestServerAllocator(t, p)
 }
 
+func TestRequestStatMany(t *testing.T) {
+	p := clientRequestServerPair(t)
+	defer p.Close()
+	_, err := putTestFile(p.cli, "/foo", "hello")
+	require.NoError(t, err)
+	_, err = putTestFile(p.cli, "/bar", "goodbye")
+	require.NoError(t, err)
+	require.NoError(t, p.cli.Mkdir("/dir"))
+
+	paths := []string{"/foo", "/missing", "/bar", "/dir", "/dir/missing"}
+	infos, errs := p.cli.StatMany(paths)
+	require.Len(t, infos, len(paths))
+	require.Len(t, errs, len(paths))
+	for i, want := range []struct {
+		name string
+		size int64
+		dir  bool
+		err  error
+	}{
+		{name: "foo", size: 5},
+		{err: os.ErrNotExist},
+		{name: "bar", size: 7},
+		{name: "dir", dir: true},
+		{err: os.ErrNotExist},
+	} {
+		if want.err != nil {
+			assert.Nil(t, infos[i], paths[i])
+			assert.Equal(t, want.err, errs[i], paths[i])
+			continue
+		}
+		require.NoError(t, errs[i], paths[i])
+		assert.Equal(t, want.name, infos[i].Name())
+		assert.Equal(t, want.dir, infos[i].IsDir(), paths[i])
+		if !want.dir {
+			assert.Equal(t, want.size, infos[i].Size(), paths[i])
+		}
+	}
+	checkRequestServerAllocator(t, p)
+}
+
 // NOTE: Setstat is a noop in the request server tests, but we want to test
 // that is does nothing without crapping out.
 func TestRequestSetstat(t *testing.T) {
@@ -456,8 +578,8 @@ func TestRequestReaddir(t *testing.T) {
 		}
 	}
 	_, err := p.cli.ReadDir("/foo_01")
-	assert.Equal(t, &StatusError{Code: sshFxFailure,
-		msg: " /foo_01: not a directory"}, err)
+	assert.Equal(t, &os.PathError{Op: "readdir", Path: "/foo_01",
+		Err: syscall.ENOTDIR}, err)
 	_, err = p.cli.ReadDir("/does_not_exist")
 	assert.Equal(t, os.ErrNotExist, err)
 	di, err := p.cli.ReadDir("/")
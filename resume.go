@@ -0,0 +1,96 @@
+package sftp
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// UploadResumable uploads the local file local to remote, resuming an
+// earlier upload which was cut short. The part of remote already there is
+// compared with local blockSize bytes at a time, reading it back with the
+// pipelined reads of ReadAt, and the upload starts at the first block which
+// differs, so that a prefix sent before is not sent again, while a block
+// corrupted since is. remote is created if it does not exist, and cut down to
+// the size of local if it is longer. UploadResumable returns the number of
+// bytes it uploaded, which is the size of local less that of the prefix kept.
+func (c *Client) UploadResumable(local, remote string, blockSize int) (n int64, err error) {
+	if blockSize < 1 {
+		return 0, errors.Errorf("sftp: UploadResumable with a block size of %d", blockSize)
+	}
+	src, err := os.Open(local)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	lfi, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+	dst, err := c.OpenFile(remote, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	rfi, err := dst.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	resume, err := matchingPrefix(src, dst, min64(lfi.Size(), rfi.Size()), blockSize)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := src.Seek(resume, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := dst.Seek(resume, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err = dst.ReadFrom(src)
+	if err != nil {
+		return n, err
+	}
+	if rfi.Size() > lfi.Size() {
+		if err := dst.Truncate(lfi.Size()); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// matchingPrefix compares the first size bytes of local and remote,
+// blockSize bytes at a time, and returns the length of the blocks they share
+// before the first which differs.
+func matchingPrefix(local io.ReaderAt, remote *File, size int64, blockSize int) (int64, error) {
+	lb := make([]byte, blockSize)
+	rb := make([]byte, blockSize)
+	var off int64
+	for off < size {
+		l := int(min64(int64(blockSize), size-off))
+		if _, err := local.ReadAt(lb[:l], off); err != nil {
+			return 0, err
+		}
+		if _, err := remote.ReadAt(rb[:l], off); err != nil {
+			return 0, err
+		}
+		if !bytes.Equal(lb[:l], rb[:l]) {
+			break
+		}
+		off += int64(l)
+	}
+	return off, nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
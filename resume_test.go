@@ -0,0 +1,73 @@
+package sftp
+
+import (
+	"bytes"
+	"encoding"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestClientUploadResumable(t *testing.T) {
+	want := make([]byte, 10000)
+	for i := range want {
+		want[i] = byte(i * 7)
+	}
+	lf, err := ioutil.TempFile("", "sftptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(lf.Name())
+	if _, err := lf.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	lf.Close()
+
+	for _, tt := range []struct {
+		desc   string
+		remote []byte
+		sent   int64
+	}{
+		{"nothing uploaded", nil, 10000},
+		{"cut short mid-block", want[:4500], 10000 - 4500},
+		{"corrupt second block", append(append(append([]byte(nil), want[:1500]...), 'x'), want[1501:6000]...), 10000 - 1000},
+		{"complete", want, 0},
+		{"longer than the file", append(append([]byte(nil), want...), "trailing"...), 0},
+	} {
+		remote := tt.remote
+		files := map[string]*[]byte{"/upload": &remote}
+		serve := memFilesServer(files, 1<<20)
+		var closes int
+		c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+			if typ == sshFxpClose {
+				closes++
+			}
+			if typ == sshFxpFsetstat {
+				// only truncation is asked for
+				id, rest := unmarshalUint32(data)
+				_, rest = unmarshalString(rest)
+				_, rest = unmarshalUint32(rest)
+				size, _ := unmarshalUint64(rest)
+				remote = remote[:size]
+				return fakeStatus(id, sshFxOk)
+			}
+			return serve(typ, data)
+		}, MaxPacket(1024))
+
+		n, err := c.UploadResumable(lf.Name(), "/upload", 1000)
+		c.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tt.desc, err)
+			continue
+		}
+		if n != tt.sent {
+			t.Errorf("%s: uploaded %d bytes, want %d", tt.desc, n, tt.sent)
+		}
+		if !bytes.Equal(remote, want) {
+			t.Errorf("%s: remote file differs from the local one", tt.desc)
+		}
+		if closes != 1 {
+			t.Errorf("%s: remote file closed %d times, want 1", tt.desc, closes)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package sftp
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// rotateCheckWrites is how many writes a rotating writer makes between
+// FSTATs of its file, to notice what other writers have appended to it.
+const rotateCheckWrites = 32
+
+// NewRotatingWriter returns a writer which appends to the remote file path,
+// creating it if need be, and rotates it once it has grown to maxSize bytes:
+// path is renamed to path.1, replacing any earlier one, and a fresh path is
+// started. Each Write goes to a single file, so that a log line written in
+// one call is never split across a rotation.
+//
+// The size of the file is learnt when it is opened and kept up to date by
+// counting writes, with an FSTAT every few writes and before rotating, so
+// that appends by other writers are counted too. Should another writer have
+// rotated the file first, this writer reopens path and writes to the fresh
+// file without renaming it again. If rotating fails, the Write which
+// triggered it returns the error, and the next Write tries again.
+func (c *Client) NewRotatingWriter(path string, maxSize int64) (io.WriteCloser, error) {
+	if maxSize < 1 {
+		return nil, errors.Errorf("sftp: NewRotatingWriter with a maximum size of %d", maxSize)
+	}
+	w := &rotatingWriter{c: c, path: path, maxSize: maxSize}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+type rotatingWriter struct {
+	c       *Client
+	path    string
+	maxSize int64
+
+	mu     sync.Mutex // protects the fields below
+	f      *File      // nil once closed, or if reopening path failed
+	closed bool       // Close has been called
+	size   int64      // of f, as far as is known
+	writes int        // since size was last learnt from the server
+}
+
+// open opens path for appending and learns its size.
+func (w *rotatingWriter) open() error {
+	f, err := w.c.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND)
+	if err != nil {
+		return err
+	}
+	// opening for appending has put the offset at the end
+	w.f, w.size, w.writes = f, int64(f.offset), 0
+	return nil
+}
+
+// Write appends b to the current file, and rotates it afterwards if that
+// brings it to the maximum size.
+func (w *rotatingWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	if w.f == nil {
+		// a rotation failed to reopen path
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.f.Write(b)
+	w.size += int64(n)
+	w.writes++
+	if err != nil {
+		return n, err
+	}
+	if w.size < w.maxSize && w.writes < rotateCheckWrites {
+		return n, nil
+	}
+	fi, err := w.f.Stat()
+	if err != nil {
+		return n, err
+	}
+	w.size, w.writes = fi.Size(), 0
+	if w.size < w.maxSize {
+		return n, nil
+	}
+	return n, w.rotate()
+}
+
+// rotate moves the full file out of the way and opens a fresh one. If
+// moving it fails, path is opened again all the same, so that writing goes
+// on and the next Write tries rotating again.
+func (w *rotatingWriter) rotate() error {
+	err := w.f.Close()
+	w.f = nil
+	if err == nil {
+		err = w.moveAside()
+	}
+	if oerr := w.open(); err == nil {
+		err = oerr
+	}
+	return err
+}
+
+// moveAside renames path to path.1, replacing any earlier path.1, unless
+// another writer has rotated it already, in which case path is missing or
+// smaller than this one was.
+func (w *rotatingWriter) moveAside() error {
+	current, err := w.c.stat(w.path)
+	if err == os.ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if current.Size() < w.size {
+		return nil
+	}
+	if _, ok := w.c.HasExtension("posix-rename@openssh.com"); !ok {
+		// a plain rename fails on servers such as OpenSSH if path.1 exists
+		if err := w.c.removeFile(w.path + ".1"); err != nil && err != os.ErrNotExist {
+			return err
+		}
+	}
+	return w.c.replace(w.path, w.path+".1")
+}
+
+// Close closes the current file.
+func (w *rotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
@@ -0,0 +1,182 @@
+package sftp
+
+import (
+	"bytes"
+	"encoding"
+	"fmt"
+	"testing"
+)
+
+// memRenameServer serves files by path and by the handles of opens, which
+// stay with the content when it is renamed, as they do on a real server.
+// Like OpenSSH's, its rename does not replace an existing file.
+func memRenameServer(files map[string]*[]byte) func(typ byte, data []byte) encoding.BinaryMarshaler {
+	handles := map[string]*[]byte{}
+	return func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, rest := unmarshalUint32(data)
+		name, rest := unmarshalString(rest)
+		switch typ {
+		case sshFxpOpen:
+			if files[name] == nil {
+				files[name] = new([]byte)
+			}
+			h := fmt.Sprintf("h%d", id)
+			handles[h] = files[name]
+			return sshFxpHandlePacket{ID: id, Handle: h}
+		case sshFxpRename:
+			newname, _ := unmarshalString(rest)
+			if files[name] == nil {
+				return fakeStatus(id, sshFxNoSuchFile)
+			}
+			if files[newname] != nil {
+				return fakeStatus(id, sshFxFailure)
+			}
+			files[newname] = files[name]
+			delete(files, name)
+			return fakeStatus(id, sshFxOk)
+		case sshFxpRemove:
+			if files[name] == nil {
+				return fakeStatus(id, sshFxNoSuchFile)
+			}
+			delete(files, name)
+			return fakeStatus(id, sshFxOk)
+		case sshFxpStat:
+			if files[name] == nil {
+				return fakeStatus(id, sshFxNoSuchFile)
+			}
+			return memFileServer(files[name])(typ, data)
+		case sshFxpClose:
+			delete(handles, name)
+			return fakeStatus(id, sshFxOk)
+		}
+		if content := handles[name]; content != nil {
+			return memFileServer(content)(typ, data)
+		}
+		return fakeStatus(id, sshFxFailure)
+	}
+}
+
+func TestClientRotatingWriter(t *testing.T) {
+	files := map[string]*[]byte{}
+	c := newFakeClient(t, memRenameServer(files))
+	defer c.Close()
+
+	w, err := c.NewRotatingWriter("/app.log", 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all []byte
+	for i := 0; i < 40; i++ {
+		line := []byte(fmt.Sprintf("log line number %03d\n", i))
+		all = append(all, line...)
+		if _, err := w.Write(line); err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	old, cur := files["/app.log.1"], files["/app.log"]
+	if old == nil || cur == nil {
+		t.Fatalf("no rotation: the files are %v", files)
+	}
+	if len(*old) != 500 {
+		t.Errorf("rotated at %d bytes, want 500", len(*old))
+	}
+	if got := append(append([]byte(nil), *old...), *cur...); !bytes.Equal(got, all) {
+		t.Errorf("the rotated and current files hold\n%s\nwant\n%s", got, all)
+	}
+	if _, err := w.Write([]byte("late\n")); err == nil {
+		t.Error("Write after Close succeeded")
+	}
+}
+
+func TestClientRotatingWriterReplacesOld(t *testing.T) {
+	old := []byte("the previous rotation\n")
+	files := map[string]*[]byte{"/app.log.1": &old}
+	c := newFakeClient(t, memRenameServer(files))
+	defer c.Close()
+
+	w, err := c.NewRotatingWriter("/app.log", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for i := 0; i < 3; i++ {
+		full := bytes.Repeat([]byte{'a' + byte(i)}, 100)
+		if _, err := w.Write(full); err != nil {
+			t.Fatalf("rotation %d: %v", i, err)
+		}
+		if got := files["/app.log.1"]; got == nil || !bytes.Equal(*got, full) {
+			t.Errorf("after rotation %d the rotated file is %v, want the file just filled", i, got)
+		}
+	}
+}
+
+func TestClientRotatingWriterRotatedElsewhere(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 90)
+	files := map[string]*[]byte{"/app.log": &content}
+	c := newFakeClient(t, memRenameServer(files))
+	defer c.Close()
+
+	w, err := c.NewRotatingWriter("/app.log", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// another writer rotates the file while this one still has it open
+	files["/app.log.1"] = files["/app.log"]
+	files["/app.log"] = new([]byte)
+
+	if _, err := w.Write(bytes.Repeat([]byte("y"), 10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("fresh\n")); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if got, want := string(*files["/app.log.1"]), string(content[:90])+"yyyyyyyyyy"; got != want {
+		t.Errorf("the rotated file holds %q, want %q", got, want)
+	}
+	if got := string(*files["/app.log"]); got != "fresh\n" {
+		t.Errorf("the current file holds %q, want the write after the rotation", got)
+	}
+}
+
+func TestClientRotatingWriterRenameFails(t *testing.T) {
+	files := map[string]*[]byte{}
+	serve := memRenameServer(files)
+	failRename := true
+	c := newFakeClient(t, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		if typ == sshFxpRename && failRename {
+			failRename = false
+			id, _ := unmarshalUint32(data)
+			return fakeStatus(id, sshFxFailure)
+		}
+		return serve(typ, data)
+	})
+	defer c.Close()
+
+	w, err := c.NewRotatingWriter("/app.log", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	full := bytes.Repeat([]byte("x"), 100)
+	if _, err := w.Write(full); !isStatusCode(err, sshFxFailure) {
+		t.Fatalf("Write rotating with a failed rename: got %v, want the rename failure", err)
+	}
+	// the writer carries on with the full file, and rotates it next time
+	if _, err := w.Write([]byte("more\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("fresh\n")); err != nil {
+		t.Fatal(err)
+	}
+	if old := files["/app.log.1"]; old == nil || string(*old) != string(full)+"more\n" {
+		t.Errorf("the rotated file is %v, want the full file and the write after the failure", old)
+	}
+	if got := string(*files["/app.log"]); got != "fresh\n" {
+		t.Errorf("the current file holds %q, want the write after the rotation", got)
+	}
+}
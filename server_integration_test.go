@@ -654,6 +654,71 @@ func TestServerSymlink(t *testing.T) {
 	}
 }
 
+func TestServerMultipleClientsOneConnection(t *testing.T) {
+	listenerGo, hostGo, portGo := testServer(t, GolangSFTP, READWRITE)
+	defer listenerGo.Close()
+
+	config := &ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password("test")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	conn, err := ssh.Dial("tcp", net.JoinHostPort(hostGo, strconv.Itoa(portGo)), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client1, err := NewClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	client2, err := NewClientFromSession(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	errs := make(chan error, 2)
+	for _, client := range []*Client{client1, client2} {
+		go func(client *Client) {
+			name := "/tmp/" + randName()
+			defer os.Remove(name)
+			data := randData(256 * 1024)
+			f, err := client.Create(name)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, err := f.Write(data); err != nil {
+				f.Close()
+				errs <- err
+				return
+			}
+			if err := f.Close(); err != nil {
+				errs <- err
+				return
+			}
+			got, err := ioutil.ReadFile(name)
+			if err == nil && !bytes.Equal(got, data) {
+				err = fmt.Errorf("%s: content mismatch", name)
+			}
+			errs <- err
+		}(client)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
 func TestServerPut(t *testing.T) {
 	listenerGo, hostGo, portGo := testServer(t, GolangSFTP, READONLY)
 	defer listenerGo.Close()
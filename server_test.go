@@ -2,6 +2,7 @@ package sftp
 
 import (
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"regexp"
@@ -344,3 +345,62 @@ func TestOpenStatRace(t *testing.T) {
 	os.Remove(tmppath)
 	checkServerAllocator(t, server)
 }
+
+// Test that SETSTAT and FSETSTAT decode their attributes in wire order,
+// and stop at the first change which fails.
+func TestServerSetstatAttrs(t *testing.T) {
+	skipIfWindows(t)
+	dir, err := ioutil.TempDir("", "sftptest-setstat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	svr := &Server{openFiles: make(map[string]*os.File)}
+	handles := make(map[string]string)
+	for _, p := range []string{file, dir} {
+		f, err := os.Open(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handles[p] = svr.nextHandle(f)
+		defer svr.closeHandle(handles[p])
+	}
+
+	owner := marshalUint32(marshalUint32(nil, uint32(os.Getuid())), uint32(os.Getgid()))
+	for _, tc := range []struct {
+		name  string
+		path  string
+		flags uint32
+		attrs []byte
+		code  uint32
+		mode  os.FileMode
+	}{
+		{"uid/gid then mode", file, sshFileXferAttrUIDGID | sshFileXferAttrPermissions, marshalUint32(owner, 0600), sshFxOk, 0600},
+		// truncating a directory fails, which must leave its mode alone
+		{"failed truncate", dir, sshFileXferAttrSize | sshFileXferAttrPermissions, marshalUint32(marshalUint64(nil, 0), 0700), sshFxFailure, 0755},
+	} {
+		for _, pkt := range []serverRespondablePacket{
+			&sshFxpSetstatPacket{ID: 1, Path: tc.path, Flags: tc.flags, Attrs: tc.attrs},
+			&sshFxpFsetstatPacket{ID: 2, Handle: handles[tc.path], Flags: tc.flags, Attrs: tc.attrs},
+		} {
+			if err := os.Chmod(tc.path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if status, ok := pkt.respond(svr).(sshFxpStatusPacket); !ok || status.Code != tc.code {
+				t.Errorf("%T %s: got status code %d, want %d", pkt, tc.name, status.Code, tc.code)
+			}
+			fi, err := os.Stat(tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != tc.mode {
+				t.Errorf("%T %s: mode %v, want %v", pkt, tc.name, fi.Mode().Perm(), tc.mode)
+			}
+		}
+	}
+}
@@ -179,11 +179,83 @@ func (f fx) String() string {
 		return "SSH_FX_CONNECTION_LOST"
 	case sshFxOPUnsupported:
 		return "SSH_FX_OP_UNSUPPORTED"
+	case sshFxInvalidHandle:
+		return "SSH_FX_INVALID_HANDLE"
+	case sshFxNoSuchPath:
+		return "SSH_FX_NO_SUCH_PATH"
+	case sshFxFileAlreadyExists:
+		return "SSH_FX_FILE_ALREADY_EXISTS"
+	case sshFxWriteProtect:
+		return "SSH_FX_WRITE_PROTECT"
+	case sshFxNoMedia:
+		return "SSH_FX_NO_MEDIA"
+	case sshFxNoSpaceOnFilesystem:
+		return "SSH_FX_NO_SPACE_ON_FILESYSTEM"
+	case sshFxQuotaExceeded:
+		return "SSH_FX_QUOTA_EXCEEDED"
+	case sshFxUnlnownPrincipal:
+		return "SSH_FX_UNKNOWN_PRINCIPAL"
+	case sshFxLockConflict:
+		return "SSH_FX_LOCK_CONFLICT"
+	case sshFxDitNotEmpty:
+		return "SSH_FX_DIR_NOT_EMPTY"
+	case sshFxNotADirectory:
+		return "SSH_FX_NOT_A_DIRECTORY"
+	case sshFxInvalidFilename:
+		return "SSH_FX_INVALID_FILENAME"
+	case sshFxLinkLoop:
+		return "SSH_FX_LINK_LOOP"
+	case sshFxCannotDelete:
+		return "SSH_FX_CANNOT_DELETE"
+	case sshFxInvalidParameter:
+		return "SSH_FX_INVALID_PARAMETER"
+	case sshFxFileIsADirectory:
+		return "SSH_FX_FILE_IS_A_DIRECTORY"
+	case sshFxByteRangeLockConflict:
+		return "SSH_FX_BYTE_RANGE_LOCK_CONFLICT"
+	case sshFxByteRangeLockRefused:
+		return "SSH_FX_BYTE_RANGE_LOCK_REFUSED"
+	case sshFxDeletePending:
+		return "SSH_FX_DELETE_PENDING"
+	case sshFxFileCorrupt:
+		return "SSH_FX_FILE_CORRUPT"
+	case sshFxOwnerInvalid:
+		return "SSH_FX_OWNER_INVALID"
+	case sshFxGroupInvalid:
+		return "SSH_FX_GROUP_INVALID"
+	case sshFxNoMatchingByteRangeLock:
+		return "SSH_FX_NO_MATCHING_BYTE_RANGE_LOCK"
 	default:
 		return "unknown"
 	}
 }
 
+// A TransportError is returned when the reader or writer which carries the
+// SFTP packets fails, for example because the connection was reset. It tells
+// such failures apart from a *StatusError, which the server sends back when
+// it could not carry out a request: after a TransportError the connection is
+// gone, and no further request on it can succeed.
+type TransportError struct {
+	Op  string // "send" or "receive"
+	Err error  // the error of the underlying reader or writer
+	// Early is set when the server closed the stream after its VERSION
+	// and before answering any request, as a misconfigured subsystem does.
+	Early bool
+}
+
+func (e *TransportError) Error() string {
+	if e.Early {
+		return fmt.Sprintf("failed to %s packet: server closed the session before answering any request: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("failed to %s packet: %v", e.Op, e.Err)
+}
+
+// Unwrap returns the underlying error, for errors.Is and errors.As.
+func (e *TransportError) Unwrap() error { return e.Err }
+
+// Cause returns the underlying error, for errors.Cause.
+func (e *TransportError) Cause() error { return e.Err }
+
 type unexpectedPacketErr struct {
 	want, got uint8
 }
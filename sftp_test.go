@@ -73,3 +73,13 @@ func TestExtensions(t *testing.T) {
 	err = SetSFTPExtensions(supportedExtensions...)
 	assert.Equal(t, supportedSFTPExtensions, sftpExtensions)
 }
+
+func TestStatusErrorNames(t *testing.T) {
+	err := &StatusError{Code: sshFxByteRangeLockConflict, msg: "locked by another client"}
+	assert.Equal(t, `sftp: "locked by another client" (SSH_FX_BYTE_RANGE_LOCK_CONFLICT)`, err.Error())
+
+	for code := uint32(sshFxOk); code <= sshFxNoMatchingByteRangeLock; code++ {
+		assert.NotEqual(t, "unknown", fx(code).String(), "code %d", code)
+	}
+	assert.Equal(t, "unknown", fx(sshFxNoMatchingByteRangeLock+1).String())
+}
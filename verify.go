@@ -0,0 +1,103 @@
+package sftp
+
+import (
+	"bytes"
+	"hash"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrSizeMismatch is the cause of the error VerifyUpload returns when
+	// the remote file is not the expected size.
+	ErrSizeMismatch = errors.New("sftp: size mismatch")
+	// ErrChecksumMismatch is the cause of the error VerifyUpload returns
+	// when the server's checksum of the remote file is not the expected one.
+	ErrChecksumMismatch = errors.New("sftp: checksum mismatch")
+)
+
+// VerifyUpload checks that the file remote is size bytes long and, if
+// wantSum is not empty and the server supports the check-file extension,
+// that the server computes the checksum wantSum for it with the hash
+// algorithm algo, such as "sha256" or "md5". It returns nil if so. When the
+// server does not support the extension, only the size is checked.
+//
+// If the size is wrong, errors.Cause of the returned error is
+// ErrSizeMismatch; if the checksum is, it is ErrChecksumMismatch. Any other
+// error means the file could not be checked.
+func (c *Client) VerifyUpload(remote string, size int64, wantSum []byte, algo string) error {
+	fi, err := c.Stat(remote)
+	if err != nil {
+		return err
+	}
+	if fi.Size() != size {
+		return errors.Wrapf(ErrSizeMismatch, "%s is %d bytes, want %d", remote, fi.Size(), size)
+	}
+	if len(wantSum) == 0 {
+		return nil
+	}
+	if _, ok := c.HasExtension("check-file"); !ok {
+		return nil
+	}
+	sum, err := c.checkFileName(remote, algo)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, wantSum) {
+		return errors.Wrapf(ErrChecksumMismatch, "%s has %s %x, want %x", remote, algo, sum, wantSum)
+	}
+	return nil
+}
+
+// DownloadAndHash reads the whole of the file path into h, with the pipelined
+// reads of WriteTo, and returns the number of bytes read. The digest is then
+// h.Sum(nil), which lets a caller verify a file without the check-file
+// extension in a single pass.
+func (c *Client) DownloadAndHash(path string, h hash.Hash) (int64, error) {
+	f, err := c.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.WriteTo(h)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// checkFileName asks the server for the algo hash of the whole file p.
+func (c *Client) checkFileName(p, algo string) ([]byte, error) {
+	id := c.nextID()
+	typ, data, err := c.sendPacket(sshFxpCheckFileNamePacket{
+		ID:         id,
+		Path:       p,
+		Algorithms: algo,
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case sshFxpExtendedReply:
+		sid, data := unmarshalUint32(data)
+		if sid != id {
+			return nil, &unexpectedIDErr{id, sid}
+		}
+		// the reply repeats the extension name, then names the algorithm
+		// the server picked from those asked for
+		if _, data, err = unmarshalStringSafe(data); err != nil {
+			return nil, err
+		}
+		used, data, err := unmarshalStringSafe(data)
+		if err != nil {
+			return nil, err
+		}
+		if used != algo {
+			return nil, errors.Errorf("sftp: server hashed %s with %s, not %s", p, used, algo)
+		}
+		return data, nil
+	case sshFxpStatus:
+		return nil, normaliseError(unmarshalStatus(id, data))
+	default:
+		return nil, unimplementedPacketErr(typ)
+	}
+}
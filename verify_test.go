@@ -0,0 +1,85 @@
+package sftp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// checkFileReply is the reply of a fake server to check-file-name.
+type checkFileReply struct {
+	ID   uint32
+	Algo string
+	Hash []byte
+}
+
+func (p checkFileReply) MarshalBinary() ([]byte, error) {
+	b := []byte{sshFxpExtendedReply}
+	b = marshalUint32(b, p.ID)
+	b = marshalString(b, "check-file")
+	b = marshalString(b, p.Algo)
+	return append(b, p.Hash...), nil
+}
+
+func TestClientVerifyUpload(t *testing.T) {
+	content := []byte("uploaded contents")
+	sum := sha256.Sum256(content)
+	var checks int
+	c := newFakeClientExt(t, []sshExtensionPair{{"check-file", "1"}}, func(typ byte, data []byte) encoding.BinaryMarshaler {
+		id, rest := unmarshalUint32(data)
+		switch typ {
+		case sshFxpStat:
+			return sshFxpStatResponse{ID: id, info: &fileInfo{name: "f", size: int64(len(content))}}
+		case sshFxpExtended:
+			ext, rest := unmarshalString(rest)
+			_, rest = unmarshalString(rest)
+			algo, _ := unmarshalString(rest)
+			if ext != "check-file-name" || algo != "sha256" {
+				return fakeStatus(id, sshFxOPUnsupported)
+			}
+			checks++
+			return checkFileReply{ID: id, Algo: algo, Hash: sum[:]}
+		}
+		return fakeStatus(id, sshFxOPUnsupported)
+	})
+	defer c.Close()
+
+	if err := c.VerifyUpload("/f", int64(len(content)), sum[:], "sha256"); err != nil {
+		t.Errorf("VerifyUpload of a good upload: %v", err)
+	}
+	if checks != 1 {
+		t.Errorf("%d checksum requests, want 1", checks)
+	}
+
+	err := c.VerifyUpload("/f", int64(len(content))+1, sum[:], "sha256")
+	if errors.Cause(err) != ErrSizeMismatch {
+		t.Errorf("VerifyUpload with the wrong size: got %v, want ErrSizeMismatch", err)
+	}
+
+	bad := sha256.Sum256([]byte("something else"))
+	err = c.VerifyUpload("/f", int64(len(content)), bad[:], "sha256")
+	if errors.Cause(err) != ErrChecksumMismatch {
+		t.Errorf("VerifyUpload with the wrong checksum: got %v, want ErrChecksumMismatch", err)
+	}
+}
+
+func TestClientDownloadAndHash(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	c := newFakeClient(t, memFileServer(&content), MaxPacket(1024))
+	defer c.Close()
+
+	h := sha256.New()
+	n, err := c.DownloadAndHash("/f", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(content)) {
+		t.Errorf("read %d bytes, want %d", n, len(content))
+	}
+	if want := sha256.Sum256(content); !bytes.Equal(h.Sum(nil), want[:]) {
+		t.Errorf("got sha256 %x, want %x", h.Sum(nil), want)
+	}
+}